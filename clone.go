@@ -8,7 +8,7 @@ import (
 
 type (
 	// DatabaseDump is the output of a Download call, containing every record that was downloaded.
-	// It is safe to transport as JSON.
+	// It is safe to transport as JSON, though use WriteDump and ReadDump to keep the exact type of every value.
 	DatabaseDump []map[string]any
 
 	// Opt is a functional option that can be passed to Download.
@@ -29,6 +29,22 @@ func DontInclude(table string) Opt {
 	}
 }
 
+// TrackProvenance records why each row was included in the dump.
+// After Download returns, (*out)[i] is the chain of lookups that found the i'th row of the dump.
+func TrackProvenance(out *[]Provenance) Opt {
+	return func(m *downloadOpts) {
+		m.provenance = out
+	}
+}
+
+// SeenKeys tracks the lookups that Download has already made in `set`, instead of in memory.
+// Use a DiskKeySet to keep memory bounded for very large exports.
+func SeenKeys(set KeySet) Opt {
+	return func(m *downloadOpts) {
+		m.seen = set
+	}
+}
+
 // LimitSize causes the clone to fail if more than `limit` records have been collected.
 // You should use an estimate of a higher bound for how many records you expect to be exported.
 // The default limit is 0, and 0 is treated as having no limit.
@@ -49,6 +65,29 @@ type downloadOpts struct {
 	dontInclude map[string]bool
 	dontRecurse map[string]bool
 	limit       int
+	provenance  *[]Provenance
+	seen        KeySet
+}
+
+// Lookup is a single search made by Download: the rows of Table where Column equals Value.
+type Lookup struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	Value  any    `json:"value"`
+	// Via is the foreign key that was followed to make this lookup. It is nil for the starting lookup.
+	Via *ForeignKey `json:"via,omitempty"`
+}
+
+// Provenance is the chain of lookups, from the starting row to the row itself, that caused a row to be included in a dump.
+// It is safe to transport as JSON alongside the DatabaseDump.
+type Provenance []Lookup
+
+func (p Provenance) String() string {
+	steps := make([]string, 0, len(p))
+	for _, l := range p {
+		steps = append(steps, fmt.Sprintf(`%s.%s=%v`, l.Table, l.Column, l.Value))
+	}
+	return strings.Join(steps, " -> ")
 }
 
 // Download recursively downloads a dump of the database from a given starting point.
@@ -57,6 +96,7 @@ func Download(ctx context.Context, db Database, startTable, startColumn string,
 	options := downloadOpts{
 		dontInclude: map[string]bool{},
 		dontRecurse: map[string]bool{},
+		seen:        NewMemoryKeySet(),
 	}
 	for _, o := range opts {
 		o(&options)
@@ -68,34 +108,110 @@ func Download(ctx context.Context, db Database, startTable, startColumn string,
 		Value      any
 	}
 
-	lookupQueue := []searchParams{{TableName: startTable, ColumnName: startColumn, Value: startId}}
-	lookupStatus := map[searchParams]bool{lookupQueue[0]: false}
+	// cameFrom records the row lookup and foreign key that first queued each lookup, for provenance
+	type edge struct {
+		from searchParams
+		fk   ForeignKey
+	}
+
+	keyOf := func(l searchParams) string {
+		return fmt.Sprintf("%s\x00%s\x00%v", l.TableName, l.ColumnName, l.Value)
+	}
+
+	// pending groups the unsearched lookups by table, so that a search can batch all of them,
+	// and tableQueue is the order in which tables gained pending lookups.
+	// searched lookups are only remembered in options.seen, so they can be kept out of memory.
+	root := searchParams{TableName: startTable, ColumnName: startColumn, Value: startId}
+	pending := map[string][]searchParams{startTable: {root}}
+	isPending := map[string]bool{keyOf(root): true}
+	tableQueue := []string{startTable}
+	cameFrom := map[string]edge{}
 	cloneInOrder := make(DatabaseDump, 0)
+	provenance := make([]Provenance, 0)
 	fks := db.ForeignKeys()
 	debugging := []string{}
 
-	var recurse func(int) error
-	recurse = func(i int) error {
+	// status reports whether a lookup has been seen at all, and whether it has been searched
+	status := func(lookup searchParams) (seen, searched bool, err error) {
+		k := keyOf(lookup)
+		if isPending[k] {
+			return true, false, nil
+		}
+		searched, err = options.seen.Has(k)
+		return searched, searched, err
+	}
+
+	enqueue := func(lookup searchParams) {
+		if len(pending[lookup.TableName]) == 0 {
+			tableQueue = append(tableQueue, lookup.TableName)
+		}
+		pending[lookup.TableName] = append(pending[lookup.TableName], lookup)
+		isPending[keyOf(lookup)] = true
+	}
+
+	trace := func(from searchParams, fk ForeignKey, lookup searchParams) {
+		if options.provenance == nil {
+			return
+		}
+		if _, ok := cameFrom[keyOf(lookup)]; !ok {
+			cameFrom[keyOf(lookup)] = edge{from: from, fk: fk}
+		}
+	}
+
+	chain := func(l searchParams) Provenance {
+		out := Provenance{}
+		for {
+			step := Lookup{Table: l.TableName, Column: l.ColumnName, Value: l.Value}
+			e, ok := cameFrom[keyOf(l)]
+			if ok {
+				fk := e.fk
+				step.Via = &fk
+			}
+			out = append(out, step)
+			if !ok {
+				break
+			}
+			l = e.from
+		}
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+		return out
+	}
+
+	var recurse func(string) error
+	recurse = func(tname string) error {
 		if options.limit != 0 && len(cloneInOrder) >= options.limit {
 			debugging = append(debugging, "hit maximum recursion")
 			return fmt.Errorf("%d export limit exceeded", options.limit)
 		}
 
-		if lookupStatus[lookupQueue[i]] {
+		batched := pending[tname]
+		if len(batched) == 0 {
 			return nil
 		}
-		tname := lookupQueue[i].TableName
+		delete(pending, tname)
+
 		conditions := make(map[string][]any, 1)
-		ors := make([]string, 0)
-		for _, l := range lookupQueue[i:] {
-			if l.TableName != tname || lookupStatus[l] {
-				continue
-			}
+		ors := make([]string, 0, len(batched))
+		for _, l := range batched {
 			conditions[l.ColumnName] = append(conditions[l.ColumnName], l.Value)
-			lookupStatus[l] = true
+			delete(isPending, keyOf(l))
+			if _, err := options.seen.Add(keyOf(l)); err != nil {
+				return err
+			}
 			ors = append(ors, fmt.Sprintf(`%s=%v`, l.ColumnName, l.Value))
 		}
 
+		// index the batch by column and value, so each found row can be attributed to its lookup
+		var batchedBy map[string]searchParams
+		if options.provenance != nil {
+			batchedBy = make(map[string]searchParams, len(batched))
+			for _, l := range batched {
+				batchedBy[fmt.Sprintf(`%s=%v`, l.ColumnName, l.Value)] = l
+			}
+		}
+
 		// ask the DB implementation for matching rows
 		foundInThisScan, err := db.SelectMatchingRows(tname, conditions)
 		if err != nil {
@@ -104,18 +220,35 @@ func Download(ctx context.Context, db Database, startTable, startColumn string,
 
 		debugging = append(debugging, fmt.Sprintf("select `%s` where `%s`: %d rows", tname, strings.Join(ors, " or "), len(foundInThisScan)))
 
+		provenanceInThisScan := make([]Provenance, 0, len(foundInThisScan))
 		for _, res := range foundInThisScan {
 			res[DumpTableKey] = tname
 
+			// find which of the batched lookups matched this row
+			foundBy := batched[0]
+			if options.provenance != nil {
+				for col := range conditions {
+					if l, ok := batchedBy[fmt.Sprintf(`%s=%v`, col, res[col])]; ok {
+						foundBy = l
+						break
+					}
+				}
+				provenanceInThisScan = append(provenanceInThisScan, chain(foundBy))
+			}
+
 			for _, fk := range fks {
 				if fk.BaseTable != tname || options.dontRecurse[fk.BaseTable] || options.dontInclude[fk.ReferencingTable] {
 					continue
 				}
 				// foreign keys pointing to this record can come later
 				lookup := searchParams{TableName: fk.ReferencingTable, ColumnName: fk.ReferencingCol, Value: res[fk.BaseCol]}
-				if _, ok := lookupStatus[lookup]; !ok {
-					lookupQueue = append(lookupQueue, lookup)
-					lookupStatus[lookup] = false
+				seen, _, err := status(lookup)
+				if err != nil {
+					return err
+				}
+				if !seen {
+					enqueue(lookup)
+					trace(foundBy, fk, lookup)
 				}
 			}
 			for _, fk := range fks {
@@ -126,32 +259,66 @@ func Download(ctx context.Context, db Database, startTable, startColumn string,
 				lookup := searchParams{TableName: fk.BaseTable, ColumnName: fk.BaseCol, Value: res[fk.ReferencingCol]}
 
 				// if its not in there, or if we haven't collected it yet
-				if !lookupStatus[lookup] {
+				seen, searched, err := status(lookup)
+				if err != nil {
+					return err
+				}
+				if !searched {
 					// immediately recurse
-					lookupQueue = append(lookupQueue, lookup)
-					if err := recurse(len(lookupQueue) - 1); err != nil {
+					trace(foundBy, fk, lookup)
+					if !seen {
+						enqueue(lookup)
+					}
+					if err := recurse(lookup.TableName); err != nil {
 						return err
 					}
 				}
 			}
 		}
 		cloneInOrder = append(cloneInOrder, foundInThisScan...)
+		provenance = append(provenance, provenanceInThisScan...)
 		return nil
 	}
 
 	// we use a buffer of search queries so we can batch them
-	// but we still need to "try" every one, even though some will be batched by earlier calls
-	for i := 0; i < len(lookupQueue); i++ {
-		if err := recurse(i); err != nil {
+	// but we still need to "try" every table, even though some will be batched by earlier calls
+	for len(tableQueue) > 0 {
+		tname := tableQueue[0]
+		tableQueue = tableQueue[1:]
+		if err := recurse(tname); err != nil {
 			return nil, debugging, err
 		}
 	}
 
+	if options.provenance != nil {
+		*options.provenance = provenance
+	}
+
 	return cloneInOrder, debugging, nil
 }
 
-// Upload uploads, in naive order, every record in a dump.
+// Upload uploads every record in a dump, ordered by SortDump so that referenced records are inserted first.
+// Foreign keys deferred by a DeferringDatabase are left out of the ordering.
 // It mutates the elements of `dump`, so you can track changes (for example new primary keys).
 func Upload(ctx context.Context, db Database, dump DatabaseDump) error {
-	return db.Insert(dump...)
+	fks := db.ForeignKeys()
+	if d, ok := db.(DeferringDatabase); ok {
+		deferred := map[ForeignKey]bool{}
+		for _, fk := range d.DeferredForeignKeys() {
+			deferred[fk] = true
+		}
+		ordered := make([]ForeignKey, 0, len(fks))
+		for _, fk := range fks {
+			if !deferred[fk] {
+				ordered = append(ordered, fk)
+			}
+		}
+		fks = ordered
+	}
+
+	sorted, err := SortDump(fks, dump)
+	if err != nil {
+		return err
+	}
+	return db.Insert(sorted...)
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/ProlificLabs/datapasta"
 	"github.com/stretchr/testify/assert"
@@ -33,6 +34,25 @@ func TestDownloadUpload(t *testing.T) {
 	assert.Equal(11, res[3]["company_id"])
 }
 
+func TestDownloadProvenance(t *testing.T) {
+	db, assert := testDB{T: t}, assert.New(t)
+	provenance := []datapasta.Provenance{}
+	res, _, err := datapasta.Download(context.Background(), db, "company", "id", 10, datapasta.TrackProvenance(&provenance))
+	assert.NoError(err)
+	assert.Len(provenance, len(res))
+
+	// the company is the root, so it has no foreign key edge
+	assert.Equal(datapasta.Provenance{{Table: "company", Column: "id", Value: 10}}, provenance[0])
+
+	// the factory was found through the product that references it
+	assert.Equal("factory", res[1][datapasta.DumpTableKey])
+	assert.Equal("company.id=10 -> product.company_id=10 -> factory.id=23", provenance[1].String())
+	assert.Equal("product", provenance[1][2].Via.ReferencingTable)
+	assert.Equal("factory_id", provenance[1][2].Via.ReferencingCol)
+
+	assert.Equal("company.id=10 -> company_details.company_id=10", provenance[3].String())
+}
+
 func cleanup(row map[string]any) {
 	if row[datapasta.DumpTableKey] == "company" {
 		row["api_key"] = "obfuscated"
@@ -133,3 +153,202 @@ func (d testDB) ForeignKeys() []datapasta.ForeignKey {
 }
 
 var _ datapasta.Database = testDB{}
+
+func BenchmarkDownload(b *testing.B) {
+	for _, users := range []int{1_000, 10_000, 50_000} {
+		db := newSyntheticDB(users)
+		b.Run(fmt.Sprintf("users=%d", users), func(b *testing.B) {
+			rows, elapsed := 0, time.Duration(0)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				db.reset()
+				b.StartTimer()
+
+				start := time.Now()
+				res, _, err := datapasta.Download(context.Background(), db, "company", "id", 1)
+				elapsed += time.Since(start)
+				if err != nil {
+					b.Fatal(err)
+				}
+				rows = len(res)
+			}
+			if rows != len(db.rows["company"])+len(db.rows["user"])+len(db.rows["post"])+len(db.rows["category"]) {
+				b.Fatalf("unexpected export size %d", rows)
+			}
+			// export time should stay roughly linear, so the time per row should stay roughly flat
+			b.ReportMetric(float64(elapsed.Nanoseconds())/float64(b.N*rows), "ns/row")
+		})
+	}
+}
+
+// syntheticDB is an in-memory schema of one company with many users, who each write posts in shared categories.
+// every post replies to the previous one, so the posts also form one long self-referencing chain.
+type syntheticDB struct {
+	rows  map[string][]map[string]any
+	index map[string]map[string]map[any][]int
+	seen  map[string]map[int]bool
+}
+
+func newSyntheticDB(users int) *syntheticDB {
+	db := &syntheticDB{rows: map[string][]map[string]any{}}
+	db.rows["company"] = append(db.rows["company"], map[string]any{"id": 1})
+	for c := 1; c <= 100; c++ {
+		db.rows["category"] = append(db.rows["category"], map[string]any{"id": c})
+	}
+	for u := 1; u <= users; u++ {
+		db.rows["user"] = append(db.rows["user"], map[string]any{"id": u, "company_id": 1})
+		for p := 0; p < 2; p++ {
+			id := len(db.rows["post"]) + 1
+			db.rows["post"] = append(db.rows["post"], map[string]any{"id": id, "user_id": u, "category_id": id%100 + 1, "reply_to_id": id - 1})
+		}
+	}
+
+	db.index = map[string]map[string]map[any][]int{}
+	for table, rows := range db.rows {
+		db.index[table] = map[string]map[any][]int{}
+		for i, row := range rows {
+			for col, val := range row {
+				if db.index[table][col] == nil {
+					db.index[table][col] = map[any][]int{}
+				}
+				db.index[table][col][val] = append(db.index[table][col][val], i)
+			}
+		}
+	}
+	db.reset()
+	return db
+}
+
+func (d *syntheticDB) reset() {
+	d.seen = map[string]map[int]bool{}
+	for table := range d.rows {
+		d.seen[table] = map[int]bool{}
+	}
+}
+
+func (d *syntheticDB) SelectMatchingRows(tname string, conds map[string][]any) ([]map[string]any, error) {
+	out := []map[string]any{}
+	for col, vals := range conds {
+		for _, val := range vals {
+			for _, i := range d.index[tname][col][val] {
+				if d.seen[tname][i] {
+					continue
+				}
+				d.seen[tname][i] = true
+				row := make(map[string]any, len(d.rows[tname][i]))
+				for k, v := range d.rows[tname][i] {
+					row[k] = v
+				}
+				out = append(out, row)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (d *syntheticDB) ForeignKeys() []datapasta.ForeignKey {
+	return []datapasta.ForeignKey{
+		{BaseTable: "company", BaseCol: "id", ReferencingTable: "user", ReferencingCol: "company_id"},
+		{BaseTable: "user", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "user_id"},
+		{BaseTable: "category", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "category_id"},
+		{BaseTable: "post", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "reply_to_id"},
+	}
+}
+
+func (d *syntheticDB) PrimaryKeys() map[string]string {
+	return map[string]string{"company": "id", "user": "id", "post": "id", "category": "id"}
+}
+
+// stubbed for interface
+
+func (d *syntheticDB) InsertRecord(map[string]any) (any, error)                { return nil, nil }
+func (d *syntheticDB) Update(id datapasta.RecordID, cols map[string]any) error { return nil }
+func (d *syntheticDB) Delete(id datapasta.RecordID) error                      { return nil }
+func (d *syntheticDB) Insert(records ...map[string]any) error                  { return nil }
+func (d *syntheticDB) Mapping() ([]datapasta.Mapping, error)                   { return nil, nil }
+
+var _ datapasta.Database = new(syntheticDB)
+
+func TestSortDump(t *testing.T) {
+	ok := assert.New(t)
+	db := testDB{T: t}
+	details := map[string]any{datapasta.DumpTableKey: "company_details", "company_id": 10}
+	product := map[string]any{datapasta.DumpTableKey: "product", "id": 5, "company_id": 10, "factory_id": 23}
+	factory := map[string]any{datapasta.DumpTableKey: "factory", "id": 23}
+	company := map[string]any{datapasta.DumpTableKey: "company", "id": 10}
+
+	sorted, err := datapasta.SortDump(db.ForeignKeys(), datapasta.DatabaseDump{details, product, factory, company})
+	ok.NoError(err)
+	ok.Equal(datapasta.DatabaseDump{company, details, factory, product}, sorted)
+
+	// values that went through json still match
+	product["factory_id"] = float64(23)
+	sorted, err = datapasta.SortDump(db.ForeignKeys(), datapasta.DatabaseDump{product, factory, company})
+	ok.NoError(err)
+	ok.Equal(datapasta.DatabaseDump{company, factory, product}, sorted)
+
+	// including large ones, which %v would format with an exponent
+	factory["id"] = 1000000
+	product["factory_id"] = float64(1000000)
+	sorted, err = datapasta.SortDump(db.ForeignKeys(), datapasta.DatabaseDump{product, factory, company})
+	ok.NoError(err)
+	ok.Equal(datapasta.DatabaseDump{company, factory, product}, sorted)
+}
+
+func TestSortDumpCycle(t *testing.T) {
+	ok := assert.New(t)
+	fks := []datapasta.ForeignKey{
+		{BaseTable: "contact", BaseCol: "id", ReferencingTable: "company", ReferencingCol: "primary_contact_id"},
+		{BaseTable: "company", BaseCol: "id", ReferencingTable: "contact", ReferencingCol: "company_id"},
+		{BaseTable: "contact", BaseCol: "id", ReferencingTable: "contact", ReferencingCol: "manager_id"},
+	}
+
+	// contacts managing each other is fine, as self references are patched after inserting
+	managers := datapasta.DatabaseDump{
+		{datapasta.DumpTableKey: "contact", "id": 1, "manager_id": 2},
+		{datapasta.DumpTableKey: "contact", "id": 2, "manager_id": 1},
+	}
+	sorted, err := datapasta.SortDump(fks, managers)
+	ok.NoError(err)
+	ok.Len(sorted, 2)
+
+	_, err = datapasta.SortDump(fks, datapasta.DatabaseDump{
+		{datapasta.DumpTableKey: "company", "id": 1, "primary_contact_id": 2},
+		{datapasta.DumpTableKey: "contact", "id": 2, "company_id": 1},
+	})
+	cycle := datapasta.CycleError{}
+	ok.ErrorAs(err, &cycle)
+	ok.Equal([]int{0, 1}, cycle.Rows)
+	ok.Equal("rows reference each other in a cycle: company[0].primary_contact_id -> contact[1].company_id -> company[0]", err.Error())
+}
+
+// cycleDB defers the foreign key from company to contact, like the Postgres client does to break the cycle.
+type cycleDB struct {
+	datapasta.Database
+	inserted []map[string]any
+}
+
+func (d *cycleDB) ForeignKeys() []datapasta.ForeignKey {
+	return append([]datapasta.ForeignKey{
+		{BaseTable: "company", BaseCol: "id", ReferencingTable: "contact", ReferencingCol: "company_id"},
+	}, d.DeferredForeignKeys()...)
+}
+
+func (d *cycleDB) DeferredForeignKeys() []datapasta.ForeignKey {
+	return []datapasta.ForeignKey{{BaseTable: "contact", BaseCol: "id", ReferencingTable: "company", ReferencingCol: "primary_contact_id"}}
+}
+
+func (d *cycleDB) Insert(records ...map[string]any) error {
+	d.inserted = append(d.inserted, records...)
+	return nil
+}
+
+func TestUploadDeferredCycle(t *testing.T) {
+	ok := assert.New(t)
+	contact := map[string]any{datapasta.DumpTableKey: "contact", "id": 2, "company_id": 1}
+	company := map[string]any{datapasta.DumpTableKey: "company", "id": 1, "primary_contact_id": 2}
+
+	db := &cycleDB{}
+	ok.NoError(datapasta.Upload(context.Background(), db, datapasta.DatabaseDump{contact, company}))
+	ok.Equal([]map[string]any{company, contact}, db.inserted)
+}
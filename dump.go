@@ -0,0 +1,366 @@
+package datapasta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgtype"
+)
+
+// dumpVersion is the version of the format written by WriteDump.
+const dumpVersion = 1
+
+// dumpFile is the format written by WriteDump.
+type dumpFile struct {
+	Version int `json:"version"`
+	// Schema describes the database the dump was exported from, and Fingerprint is its fingerprint.
+	Schema      *Schema                 `json:"schema,omitempty"`
+	Fingerprint string                  `json:"fingerprint,omitempty"`
+	Rows        []map[string]typedValue `json:"rows"`
+}
+
+// typedValue is a value along with the name of its type, written as a [type, value] pair, or null.
+type typedValue struct {
+	Type  string
+	Value json.RawMessage
+}
+
+func (v typedValue) MarshalJSON() ([]byte, error) {
+	if v.Type == "" {
+		return []byte("null"), nil
+	}
+	return json.Marshal([]any{v.Type, v.Value})
+}
+
+func (v *typedValue) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*v = typedValue{}
+		return nil
+	}
+	var pair []json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("expected a [type, value] pair, got %s", b)
+	}
+	v.Value = pair[1]
+	return json.Unmarshal(pair[0], &v.Type)
+}
+
+// textTypes are the pgtype values that are written in their postgres text format, by the name they're written with.
+var textTypes = map[string]func() pgtype.TextDecoder{
+	"uuid":          func() pgtype.TextDecoder { return &pgtype.UUID{} },
+	"numeric":       func() pgtype.TextDecoder { return &pgtype.Numeric{} },
+	"interval":      func() pgtype.TextDecoder { return &pgtype.Interval{} },
+	"bool[]":        func() pgtype.TextDecoder { return &pgtype.BoolArray{} },
+	"int2[]":        func() pgtype.TextDecoder { return &pgtype.Int2Array{} },
+	"int4[]":        func() pgtype.TextDecoder { return &pgtype.Int4Array{} },
+	"int8[]":        func() pgtype.TextDecoder { return &pgtype.Int8Array{} },
+	"float8[]":      func() pgtype.TextDecoder { return &pgtype.Float8Array{} },
+	"text[]":        func() pgtype.TextDecoder { return &pgtype.TextArray{} },
+	"varchar[]":     func() pgtype.TextDecoder { return &pgtype.VarcharArray{} },
+	"uuid[]":        func() pgtype.TextDecoder { return &pgtype.UUIDArray{} },
+	"timestamptz[]": func() pgtype.TextDecoder { return &pgtype.TimestamptzArray{} },
+}
+
+// textTypeNames has the name of every type in textTypes, by its go type.
+var textTypeNames = func() map[reflect.Type]string {
+	names := make(map[reflect.Type]string, len(textTypes))
+	for name, newValue := range textTypes {
+		names[reflect.TypeOf(newValue()).Elem()] = name
+	}
+	return names
+}()
+
+// WriteDump exports a dump as JSON, along with the type of every value, so ReadDump restores exactly the values
+// that were downloaded: integers keep their size, and timestamps, bytea, uuids and inets keep their go types.
+// `schema` describes the database the dump was exported from, such as pgdb.Schema returns, so that ReadDump
+// can return it to check with CheckSchema before uploading. It may be nil.
+func WriteDump(w io.Writer, dump DatabaseDump, schema *Schema) error {
+	file := dumpFile{Version: dumpVersion, Schema: schema, Rows: make([]map[string]typedValue, 0, len(dump))}
+	if schema != nil {
+		file.Fingerprint = schema.Fingerprint()
+	}
+	for i, row := range dump {
+		typed := make(map[string]typedValue, len(row))
+		for col, v := range row {
+			tv, err := encodeValue(v)
+			if err != nil {
+				return fmt.Errorf("row %d, column %s: %w", i, col, err)
+			}
+			typed[col] = tv
+		}
+		file.Rows = append(file.Rows, typed)
+	}
+	return json.NewEncoder(w).Encode(file)
+}
+
+// ReadDump imports a dump written by WriteDump, along with the schema it was exported from, if it was recorded.
+// Values of types that are written in their text form are read back as the type of their column in that schema.
+func ReadDump(r io.Reader) (DatabaseDump, *Schema, error) {
+	var file dumpFile
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, nil, err
+	}
+	if file.Version != dumpVersion {
+		return nil, nil, fmt.Errorf("unsupported dump version %d", file.Version)
+	}
+	ci := pgtype.NewConnInfo()
+	dump := make(DatabaseDump, 0, len(file.Rows))
+	for i, typed := range file.Rows {
+		row := make(map[string]any, len(typed))
+		var columns map[string]SchemaColumn
+		if file.Schema != nil {
+			var table string
+			if err := json.Unmarshal(typed[DumpTableKey].Value, &table); err == nil {
+				columns = file.Schema.Tables[table].Columns
+			}
+		}
+		for col, tv := range typed {
+			v, err := decodeValue(ci, tv, columns[col].Type)
+			if err != nil {
+				return nil, nil, fmt.Errorf("row %d, column %s: %w", i, col, err)
+			}
+			row[col] = v
+		}
+		dump = append(dump, row)
+	}
+	return dump, file.Schema, nil
+}
+
+// encodeValue tags a value with the name of its type.
+func encodeValue(v any) (typedValue, error) {
+	var name string
+	var out any
+	switch v := v.(type) {
+	case nil:
+		return typedValue{}, nil
+	case string:
+		name, out = "text", v
+	case bool:
+		name, out = "bool", v
+	case int:
+		name, out = "int", v
+	case int16:
+		name, out = "int2", v
+	case int32:
+		name, out = "int4", v
+	case int64:
+		name, out = "int8", v
+	case float32:
+		// floats are written as text, as JSON has no NaN or Infinity
+		name, out = "float4", strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		name, out = "float8", strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		name, out = "bytea", v
+	case time.Time:
+		name, out = "timestamptz", v
+	case uint32:
+		name, out = "oid", v
+	case int8:
+		name, out = "char", v
+	case *net.IPNet:
+		text, err := pgtype.Inet{IPNet: v, Status: pgtype.Present}.EncodeText(nil, nil)
+		if err != nil {
+			return typedValue{}, err
+		}
+		name, out = "inet", string(text)
+	case net.HardwareAddr:
+		name, out = "macaddr", v.String()
+	case map[string]any, []any:
+		name, out = "json", v
+	default:
+		// pgtype values with a Null status are written like a nil
+		if v, ok := v.(interface{ Get() any }); ok && v.Get() == nil {
+			return typedValue{}, nil
+		}
+		var ok bool
+		if name, ok = textTypeNames[reflect.TypeOf(v)]; !ok {
+			// other values are written in their text form, and read back as the type of their column
+			name = "unknown"
+		}
+		switch v := v.(type) {
+		case pgtype.TextEncoder:
+			text, err := v.EncodeText(nil, nil)
+			if err != nil {
+				return typedValue{}, err
+			}
+			out = string(text)
+		case fmt.Stringer:
+			out = v.String()
+		default:
+			return typedValue{}, fmt.Errorf("can't write values of type %T", v)
+		}
+	}
+
+	raw, err := json.Marshal(out)
+	if err != nil {
+		return typedValue{}, err
+	}
+	return typedValue{Type: name, Value: raw}, nil
+}
+
+// decodeValue restores a value tagged by encodeValue. `colType` is the type of the value's column, if it's known.
+func decodeValue(ci *pgtype.ConnInfo, tv typedValue, colType string) (any, error) {
+	into := func(v any) (any, error) {
+		if err := json.Unmarshal(tv.Value, v); err != nil {
+			return nil, err
+		}
+		return reflect.ValueOf(v).Elem().Interface(), nil
+	}
+	text := func() (string, error) {
+		var s string
+		err := json.Unmarshal(tv.Value, &s)
+		return s, err
+	}
+
+	switch tv.Type {
+	case "":
+		return nil, nil
+	case "text":
+		return into(new(string))
+	case "bool":
+		return into(new(bool))
+	case "int":
+		return into(new(int))
+	case "int2":
+		return into(new(int16))
+	case "int4":
+		return into(new(int32))
+	case "int8":
+		return into(new(int64))
+	case "float4":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		f, err := strconv.ParseFloat(s, 32)
+		return float32(f), err
+	case "float8":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseFloat(s, 64)
+	case "bytea":
+		return into(new([]byte))
+	case "timestamptz":
+		return into(new(time.Time))
+	case "inet":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		var inet pgtype.Inet
+		if err := inet.DecodeText(nil, []byte(s)); err != nil {
+			return nil, err
+		}
+		return inet.IPNet, nil
+	case "oid":
+		return into(new(uint32))
+	case "char":
+		return into(new(int8))
+	case "macaddr":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		return net.ParseMAC(s)
+	case "json":
+		return into(new(any))
+	case "unknown":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		return decodeText(ci, s, colType)
+	case "numeric":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		// numerics are written as digits and an exponent, which pgtype can't read back
+		if digits, exp, found := strings.Cut(s, "e"); found {
+			n, ok := new(big.Int).SetString(digits, 10)
+			e, err := strconv.ParseInt(exp, 10, 32)
+			if !ok || err != nil {
+				return nil, fmt.Errorf("invalid numeric %q", s)
+			}
+			return pgtype.Numeric{Int: n, Exp: int32(e), Status: pgtype.Present}, nil
+		}
+	}
+
+	newValue, ok := textTypes[tv.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", tv.Type)
+	}
+	s, err := text()
+	if err != nil {
+		return nil, err
+	}
+	value := newValue()
+	if err := value.DecodeText(nil, []byte(s)); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(value).Elem().Interface(), nil
+}
+
+// sqlTypeNames are the names pgtype registers types under, by the names format_type gives them.
+var sqlTypeNames = map[string]string{
+	"smallint":                    "int2",
+	"integer":                     "int4",
+	"bigint":                      "int8",
+	"real":                        "float4",
+	"double precision":            "float8",
+	"boolean":                     "bool",
+	"character":                   "bpchar",
+	"character varying":           "varchar",
+	"bit varying":                 "varbit",
+	"timestamp without time zone": "timestamp",
+	"timestamp with time zone":    "timestamptz",
+	"time without time zone":      "time",
+	`"char"`:                      "char",
+}
+
+// decodeText reads a value written in its text form as a value of `colType`, as rows.Values would return it.
+// Values of columns whose type isn't known, such as when the dump has no schema, are read as text.
+func decodeText(ci *pgtype.ConnInfo, s, colType string) (any, error) {
+	if colType == "" {
+		return s, nil
+	}
+	name := strings.TrimSuffix(colType, "[]")
+	array := name != colType
+	if i, j := strings.IndexByte(name, '('), strings.IndexByte(name, ')'); i >= 0 && j > i {
+		// drop the modifiers, such as a numeric's precision
+		name = name[:i] + name[j+1:]
+	}
+	if renamed, ok := sqlTypeNames[name]; ok {
+		name = renamed
+	}
+	if array {
+		name = "_" + name
+	}
+
+	dt, ok := ci.DataTypeForName(name)
+	if !ok {
+		return s, nil
+	}
+	value := pgtype.NewValue(dt.Value)
+	decoder, ok := value.(pgtype.TextDecoder)
+	if !ok {
+		return s, nil
+	}
+	if err := decoder.DecodeText(ci, []byte(s)); err != nil {
+		return nil, fmt.Errorf("reading %q as %s: %w", s, colType, err)
+	}
+	return value.Get(), nil
+}
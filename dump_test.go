@@ -0,0 +1,79 @@
+package datapasta
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteReadDump(t *testing.T) {
+	ok := assert.New(t)
+
+	var amount pgtype.Numeric
+	ok.NoError(amount.Set("1234567890.123456789"))
+	var tags pgtype.Int4Array
+	ok.NoError(tags.Set([]int32{1, 2, 3}))
+	raw := [16]byte{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+	dump := DatabaseDump{
+		{
+			DumpTableKey: "user",
+			"id":         int32(7),
+			"big_id":     int64(9007199254740993),
+			"small":      int16(3),
+			"ratio":      0.1,
+			"limit":      math.Inf(1),
+			"active":     true,
+			"name":       "alice",
+			"avatar":     []byte{0, 1, 2, 255},
+			"created_at": time.Date(2023, 4, 5, 6, 7, 8, 123456789, time.UTC),
+			"uuid":       pgtype.UUID{Bytes: raw, Status: pgtype.Present},
+			"ip":         &net.IPNet{IP: net.IP{10, 0, 0, 5}, Mask: net.CIDRMask(24, 32)},
+			"mac":        net.HardwareAddr{0x08, 0x00, 0x2b, 0x01, 0x02, 0x03},
+			"owner_oid":  uint32(16384),
+			"kind":       int8('a'),
+			"expires_at": pgtype.Infinity,
+			"amount":     amount,
+			"tags":       tags,
+			"settings":   map[string]any{"theme": "dark", "size": 12.0},
+			"nickname":   nil,
+		},
+	}
+	schema := &Schema{Tables: map[string]SchemaTable{"user": {
+		Columns: map[string]SchemaColumn{
+			"id":         {Type: "integer", HasDefault: true},
+			"amount":     {Type: "numeric(30,9)", Nullable: true},
+			"expires_at": {Type: "timestamp(3) with time zone"},
+		},
+		PrimaryKey: []string{"id"},
+	}}}
+
+	buf := &bytes.Buffer{}
+	ok.NoError(WriteDump(buf, dump, schema))
+	read, readSchema, err := ReadDump(buf)
+	ok.NoError(err)
+	ok.Equal(dump, read)
+	ok.Equal(schema, readSchema)
+
+	// without a schema, values written in their text form are read as text
+	ok.NoError(WriteDump(buf, DatabaseDump{{DumpTableKey: "user", "expires_at": pgtype.Infinity}}, nil))
+	read, _, err = ReadDump(buf)
+	ok.NoError(err)
+	ok.Equal(DatabaseDump{{DumpTableKey: "user", "expires_at": "infinity"}}, read)
+
+	// pgtype values that are NULL are written as null, and read back as nil
+	ok.NoError(WriteDump(buf, DatabaseDump{{DumpTableKey: "user", "uuid": pgtype.UUID{Status: pgtype.Null}, "amount": pgtype.Numeric{Status: pgtype.Null}}}, nil))
+	ok.Contains(buf.String(), `"uuid":null`)
+	read, _, err = ReadDump(buf)
+	ok.NoError(err)
+	ok.Equal(DatabaseDump{{DumpTableKey: "user", "uuid": nil, "amount": nil}}, read)
+
+	ok.EqualError(WriteDump(buf, DatabaseDump{{DumpTableKey: "user", "id": uint8(1)}}, nil), "row 0, column id: can't write values of type uint8")
+	_, _, err = ReadDump(bytes.NewBufferString(`{"version":1,"rows":[{"id":["money","$1.00"]}]}`))
+	ok.EqualError(err, `row 0, column id: unknown type "money"`)
+}
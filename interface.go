@@ -41,6 +41,15 @@ type Database interface {
 	PrimaryKeys() map[string]string
 }
 
+// DeferringDatabase is a Database that can insert rows before the rows they reference through some foreign keys,
+// and patch those references afterwards. Upload doesn't order a dump by those foreign keys.
+type DeferringDatabase interface {
+	Database
+
+	// DeferredForeignKeys returns the foreign keys whose references are patched after inserting.
+	DeferredForeignKeys() []ForeignKey
+}
+
 // ForeignKey contains every RERENCING column and the BASE column it refers to.
 // This is used to recurse the database as a graph.
 // Database implementations must provide a complete list of references.
@@ -0,0 +1,255 @@
+package datapasta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// KeySet remembers which keys have been seen.
+// Download and the Postgres clients use one to dedupe lookups and rows; by default it is kept in memory.
+type KeySet interface {
+	// Add records the key, and reports whether it was not already present.
+	Add(key string) (bool, error)
+
+	// Has reports whether the key has been added.
+	Has(key string) (bool, error)
+}
+
+// NewMemoryKeySet returns a KeySet that keeps every key in memory.
+func NewMemoryKeySet() KeySet {
+	return memoryKeySet{}
+}
+
+type memoryKeySet map[string]struct{}
+
+func (s memoryKeySet) Add(key string) (bool, error) {
+	if _, ok := s[key]; ok {
+		return false, nil
+	}
+	s[key] = struct{}{}
+	return true, nil
+}
+
+func (s memoryKeySet) Has(key string) (bool, error) {
+	_, ok := s[key]
+	return ok, nil
+}
+
+const (
+	// diskKeySize is the width of each hashed key stored on disk.
+	diskKeySize = 16
+
+	// diskKeySetMaxRuns is how many sorted files can accumulate before they're merged into one.
+	diskKeySetMaxRuns = 8
+)
+
+type diskKey [diskKeySize]byte
+
+// DiskKeySet is a KeySet that keeps at most `memoryLimit` keys in memory, spilling the rest to sorted files on disk.
+// Keys are stored as 128 bit hashes, so memory and disk usage don't depend on the length of the keys.
+// Call Close to remove the files once the export is done.
+type DiskKeySet struct {
+	dir         string
+	memoryLimit int
+	mem         map[diskKey]struct{}
+	runs        []diskKeyRun
+	created     int
+}
+
+// a run is a file of sorted, fixed width keys
+type diskKeyRun struct {
+	file *os.File
+	size int64
+}
+
+// NewDiskKeySet creates a KeySet that spills to a new temporary directory inside `dir` (or the os temp dir if empty).
+func NewDiskKeySet(dir string, memoryLimit int) (*DiskKeySet, error) {
+	if memoryLimit <= 0 {
+		return nil, fmt.Errorf("memory limit must be positive, got %d", memoryLimit)
+	}
+	tmp, err := os.MkdirTemp(dir, "datapasta-keys-")
+	if err != nil {
+		return nil, err
+	}
+	return &DiskKeySet{dir: tmp, memoryLimit: memoryLimit, mem: map[diskKey]struct{}{}}, nil
+}
+
+func hashDiskKey(key string) diskKey {
+	sum := sha256.Sum256([]byte(key))
+	var k diskKey
+	copy(k[:], sum[:diskKeySize])
+	return k
+}
+
+func (s *DiskKeySet) Add(key string) (bool, error) {
+	k := hashDiskKey(key)
+	found, err := s.has(k)
+	if err != nil || found {
+		return false, err
+	}
+	s.mem[k] = struct{}{}
+	if len(s.mem) >= s.memoryLimit {
+		if err := s.spill(); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func (s *DiskKeySet) Has(key string) (bool, error) {
+	return s.has(hashDiskKey(key))
+}
+
+func (s *DiskKeySet) has(k diskKey) (bool, error) {
+	if _, ok := s.mem[k]; ok {
+		return true, nil
+	}
+	for _, r := range s.runs {
+		found, err := r.search(k)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// Close removes every file used by the set.
+func (s *DiskKeySet) Close() error {
+	for _, r := range s.runs {
+		r.file.Close()
+	}
+	s.runs = nil
+	s.mem = map[diskKey]struct{}{}
+	return os.RemoveAll(s.dir)
+}
+
+// spill writes the in-memory keys to a new sorted run, merging runs if there are too many.
+func (s *DiskKeySet) spill() error {
+	keys := make([]diskKey, 0, len(s.mem))
+	for k := range s.mem {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+
+	run, err := s.writeRun(func(w *bufio.Writer) error {
+		for _, k := range keys {
+			if _, err := w.Write(k[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	s.mem = map[diskKey]struct{}{}
+
+	if len(s.runs) > diskKeySetMaxRuns {
+		return s.merge()
+	}
+	return nil
+}
+
+// merge combines every run into a single sorted run.
+func (s *DiskKeySet) merge() error {
+	readers := make([]*bufio.Reader, len(s.runs))
+	heads := make([]*diskKey, len(s.runs))
+	next := func(i int) error {
+		var k diskKey
+		if _, err := io.ReadFull(readers[i], k[:]); err == io.EOF {
+			heads[i] = nil
+			return nil
+		} else if err != nil {
+			return err
+		}
+		heads[i] = &k
+		return nil
+	}
+	for i, r := range s.runs {
+		readers[i] = bufio.NewReader(io.NewSectionReader(r.file, 0, r.size))
+		if err := next(i); err != nil {
+			return err
+		}
+	}
+
+	run, err := s.writeRun(func(w *bufio.Writer) error {
+		for {
+			least := -1
+			for i, h := range heads {
+				if h != nil && (least == -1 || bytes.Compare(h[:], heads[least][:]) < 0) {
+					least = i
+				}
+			}
+			if least == -1 {
+				return nil
+			}
+			if _, err := w.Write(heads[least][:]); err != nil {
+				return err
+			}
+			if err := next(least); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range s.runs {
+		r.file.Close()
+		os.Remove(r.file.Name())
+	}
+	s.runs = []diskKeyRun{run}
+	return nil
+}
+
+func (s *DiskKeySet) writeRun(write func(w *bufio.Writer) error) (diskKeyRun, error) {
+	s.created++
+	f, err := os.Create(filepath.Join(s.dir, fmt.Sprintf("run-%d", s.created)))
+	if err != nil {
+		return diskKeyRun{}, err
+	}
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		return diskKeyRun{}, err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return diskKeyRun{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return diskKeyRun{}, err
+	}
+	return diskKeyRun{file: f, size: info.Size()}, nil
+}
+
+// search does a binary search of the run for the key.
+func (r diskKeyRun) search(k diskKey) (bool, error) {
+	var buf diskKey
+	lo, hi := int64(0), r.size/diskKeySize
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if _, err := r.file.ReadAt(buf[:], mid*diskKeySize); err != nil {
+			return false, err
+		}
+		switch c := bytes.Compare(buf[:], k[:]); {
+		case c == 0:
+			return true, nil
+		case c < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,58 @@
+package datapasta_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ProlificLabs/datapasta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskKeySet(t *testing.T) {
+	ok := assert.New(t)
+	dir := t.TempDir()
+	set, err := datapasta.NewDiskKeySet(dir, 10)
+	ok.NoError(err)
+
+	// enough keys to spill many runs and merge them
+	for i := 0; i < 1000; i++ {
+		added, err := set.Add(fmt.Sprintf("key-%d", i))
+		ok.NoError(err)
+		ok.True(added)
+	}
+	for i := 0; i < 1000; i += 7 {
+		added, err := set.Add(fmt.Sprintf("key-%d", i))
+		ok.NoError(err)
+		ok.False(added, "key-%d was added twice", i)
+
+		has, err := set.Has(fmt.Sprintf("key-%d", i))
+		ok.NoError(err)
+		ok.True(has)
+	}
+	has, err := set.Has("key-1000")
+	ok.NoError(err)
+	ok.False(has)
+
+	ok.NoError(set.Close())
+	entries, err := os.ReadDir(dir)
+	ok.NoError(err)
+	ok.Empty(entries)
+}
+
+func TestDownloadWithDiskKeySet(t *testing.T) {
+	ok := assert.New(t)
+	set, err := datapasta.NewDiskKeySet(t.TempDir(), 16)
+	ok.NoError(err)
+	defer set.Close()
+
+	db := newSyntheticDB(100)
+	res, _, err := datapasta.Download(context.Background(), db, "company", "id", 1, datapasta.SeenKeys(set))
+	ok.NoError(err)
+
+	db.reset()
+	expected, _, err := datapasta.Download(context.Background(), db, "company", "id", 1)
+	ok.NoError(err)
+	ok.Equal(expected, res)
+}
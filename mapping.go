@@ -0,0 +1,104 @@
+package datapasta
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// mappingEntry is a Mapping as written by WriteMapping, along with the type of each key, so that keys such as uuids
+// are read back as the same go type the client's Mapping returns, and FindMapping still matches them.
+// Composite keys, and mappings written before types were recorded, have no types.
+type mappingEntry struct {
+	RecordID
+	OriginalID     any
+	PrimaryKeyType string `json:",omitempty"`
+	OriginalIDType string `json:",omitempty"`
+}
+
+// WriteMapping exports a mapping as JSON, so it can be kept after the clone's transaction is committed
+// and loaded with ReadMapping for a later merge.
+func WriteMapping(w io.Writer, mapp []Mapping) error {
+	entries := make([]mappingEntry, 0, len(mapp))
+	for _, m := range mapp {
+		e := mappingEntry{RecordID: m.RecordID, OriginalID: m.OriginalID}
+		var err error
+		if e.PrimaryKey, e.PrimaryKeyType, err = typedKey(m.PrimaryKey); err != nil {
+			return err
+		}
+		if e.OriginalID, e.OriginalIDType, err = typedKey(m.OriginalID); err != nil {
+			return err
+		}
+		entries = append(entries, e)
+	}
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// ReadMapping imports a mapping written by WriteMapping.
+// Keys are restored to the type they were written with. Integer keys without a type are read back as int64,
+// so large keys aren't rounded.
+func ReadMapping(r io.Reader) ([]Mapping, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var entries []mappingEntry
+	if err := dec.Decode(&entries); err != nil {
+		return nil, err
+	}
+	mapp := make([]Mapping, 0, len(entries))
+	for _, e := range entries {
+		pk, err := untypedKey(e.PrimaryKey, e.PrimaryKeyType)
+		if err != nil {
+			return nil, err
+		}
+		original, err := untypedKey(e.OriginalID, e.OriginalIDType)
+		if err != nil {
+			return nil, err
+		}
+		mapp = append(mapp, Mapping{RecordID: RecordID{Table: e.Table, PrimaryKey: pk}, OriginalID: original})
+	}
+	return mapp, nil
+}
+
+// typedKey returns a key as it's written in a dump, along with the name of its type.
+// Composite keys are returned as they are, without a type.
+func typedKey(key any) (any, string, error) {
+	switch key.(type) {
+	case []any, map[string]any:
+		return key, "", nil
+	}
+	tv, err := encodeValue(key)
+	if err != nil || tv.Type == "" {
+		return nil, "", err
+	}
+	return tv.Value, tv.Type, nil
+}
+
+// untypedKey restores a key written by typedKey.
+func untypedKey(key any, typ string) (any, error) {
+	if typ == "" {
+		return jsonNumber(key), nil
+	}
+	raw, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(nil, typedValue{Type: typ, Value: raw}, "")
+}
+
+// jsonNumber converts a json.Number into an int64, or a float64 if it isn't an integer, including in composite keys.
+func jsonNumber(v any) any {
+	if vals, ok := v.([]any); ok {
+		for i, val := range vals {
+			vals[i] = jsonNumber(val)
+		}
+		return vals
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	f, _ := n.Float64()
+	return f
+}
@@ -1,9 +1,11 @@
 package datapasta
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 
+	"github.com/jackc/pgtype"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -350,6 +352,29 @@ func TestGenerateMergeStrategyWithMapping(t *testing.T) {
 	ok.Equal(22, mas[1].Data["friend"])
 }
 
+func TestWriteReadMapping(t *testing.T) {
+	ok := assert.New(t)
+	mapp := []Mapping{
+		{RecordID: RecordID{Table: "person", PrimaryKey: int64(9007199254740993)}, OriginalID: int64(9007199254740995)},
+		{RecordID: RecordID{Table: "badge", PrimaryKey: "6ba7b810-9dad-11d1-80b4-00c04fd430c8"}, OriginalID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8"},
+		{RecordID: RecordID{Table: "team", PrimaryKey: pgtype.UUID{Bytes: [16]byte{1}, Status: pgtype.Present}}, OriginalID: pgtype.UUID{Bytes: [16]byte{2}, Status: pgtype.Present}},
+		{RecordID: RecordID{Table: "membership", PrimaryKey: []any{int64(1), "a"}}, OriginalID: []any{int64(2), "a"}},
+	}
+
+	buf := &bytes.Buffer{}
+	ok.NoError(WriteMapping(buf, mapp))
+	read, err := ReadMapping(buf)
+	ok.NoError(err)
+	ok.Equal(mapp, read)
+	// uuids are read back as the type the client returned, so they can still be found
+	ok.Equal(mapp[2], FindMapping(RecordID{Table: "team", PrimaryKey: pgtype.UUID{Bytes: [16]byte{1}, Status: pgtype.Present}}, read))
+
+	// mappings written without types are still read
+	read, err = ReadMapping(bytes.NewBufferString(`[{"Table":"person","PrimaryKey":9007199254740993,"OriginalID":9007199254740995}]`))
+	ok.NoError(err)
+	ok.Equal(mapp[:1], read)
+}
+
 func TestApplyMergeStrategy(t *testing.T) {
 	ok := assert.New(t)
 
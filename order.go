@@ -0,0 +1,113 @@
+package datapasta
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CycleError is returned by SortDump when rows reference each other in a cycle,
+// so there is no insert order that satisfies every foreign key.
+type CycleError struct {
+	// Rows are the indexes in the dump of the rows in the cycle. Each row references the next, and the last references the first.
+	Rows []int
+	// Via are the foreign keys each row uses to reference the next.
+	Via []ForeignKey
+}
+
+func (e CycleError) Error() string {
+	steps := make([]string, 0, len(e.Rows))
+	for i, row := range e.Rows {
+		steps = append(steps, fmt.Sprintf(`%s[%d].%s`, e.Via[i].ReferencingTable, row, e.Via[i].ReferencingCol))
+	}
+	return fmt.Sprintf("rows reference each other in a cycle: %s -> %s[%d]", strings.Join(steps, " -> "), e.Via[len(e.Via)-1].BaseTable, e.Rows[0])
+}
+
+// SortDump orders the rows of a dump so that every row comes after the rows it references, using the actual values of the foreign keys.
+// Rows that are already in a valid order keep their relative order, and the returned dump shares its rows with `dump`.
+// Cycles that only go through self-referencing foreign keys are allowed, as the batch client patches those after inserting.
+// Any other cycle is reported as a CycleError.
+func SortDump(fks []ForeignKey, dump DatabaseDump) (DatabaseDump, error) {
+	// index the rows by every column that is referenced by a foreign key
+	type column struct{ table, col string }
+	referenced := map[column]bool{}
+	for _, fk := range fks {
+		referenced[column{fk.BaseTable, fk.BaseCol}] = true
+	}
+	index := map[string][]int{}
+	for i, row := range dump {
+		table := row[DumpTableKey].(string)
+		for c := range referenced {
+			if c.table != table || row[c.col] == nil {
+				continue
+			}
+			k := table + "\x00" + c.col + "\x00" + textValue(row[c.col])
+			index[k] = append(index[k], i)
+		}
+	}
+
+	type step struct {
+		row int
+		via ForeignKey
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(dump))
+	out := make(DatabaseDump, 0, len(dump))
+	stack := []step{}
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		state[i] = visiting
+		row := dump[i]
+		table := row[DumpTableKey].(string)
+		for _, fk := range fks {
+			if fk.ReferencingTable != table || row[fk.ReferencingCol] == nil {
+				continue
+			}
+			k := fk.BaseTable + "\x00" + fk.BaseCol + "\x00" + textValue(row[fk.ReferencingCol])
+			for _, j := range index[k] {
+				if j == i || state[j] == visited {
+					continue
+				}
+				stack = append(stack, step{row: i, via: fk})
+				if state[j] == visiting {
+					// find where the cycle starts on the stack
+					start := len(stack) - 1
+					for stack[start].row != j {
+						start--
+					}
+					selfOnly := true
+					cycle := CycleError{}
+					for _, s := range stack[start:] {
+						cycle.Rows = append(cycle.Rows, s.row)
+						cycle.Via = append(cycle.Via, s.via)
+						selfOnly = selfOnly && s.via.BaseTable == s.via.ReferencingTable
+					}
+					if !selfOnly {
+						return cycle
+					}
+				} else if err := visit(j); err != nil {
+					return err
+				}
+				stack = stack[:len(stack)-1]
+			}
+		}
+		state[i] = visited
+		out = append(out, row)
+		return nil
+	}
+
+	for i := range dump {
+		if state[i] != unvisited {
+			continue
+		}
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
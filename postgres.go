@@ -4,6 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Masterminds/squirrel"
@@ -30,23 +34,88 @@ func NewPostgres(ctx context.Context, c Postgreser) (pgdb, error) {
 		pkGroups[pk.TableName] = pk
 	}
 
+	sqlcKeyColumns, err := client.GetPrimaryKeyColumns(ctx)
+	if err != nil {
+		return pgdb{}, err
+	}
+	pkColumns := make(map[string][]string, len(sqlcKeyColumns))
+	for _, pk := range sqlcKeyColumns {
+		pkColumns[pk.TableName] = pk.ColumnNames
+	}
+
 	fks := make([]ForeignKey, 0, len(sqlcFKs))
 	for _, fk := range sqlcFKs {
 		fks = append(fks, ForeignKey(fk))
 	}
 
+	sqlcUniques, err := client.GetUniqueIndexes(ctx)
+	if err != nil {
+		return pgdb{}, err
+	}
+	uniques := uniqueColumns(pkGroups, fks, sqlcUniques)
+
+	sqlcOptions, err := client.GetForeignKeyOptions(ctx)
+	if err != nil {
+		return pgdb{}, err
+	}
+	cycles := breakCycles(fks, sqlcOptions)
+
+	sqlcColumns, err := client.GetColumns(ctx)
+	if err != nil {
+		return pgdb{}, err
+	}
+	columns := make(map[string]map[string]getColumnsRow)
+	for _, c := range sqlcColumns {
+		if columns[c.TableName] == nil {
+			columns[c.TableName] = make(map[string]getColumnsRow)
+		}
+		columns[c.TableName][c.ColumnName] = c
+	}
+
+	sqlcInherited, err := client.GetInheritedTables(ctx)
+	if err != nil {
+		return pgdb{}, err
+	}
+	inherited := make(map[string]bool, len(sqlcInherited))
+	for _, table := range sqlcInherited {
+		inherited[table] = true
+	}
+
+	userTypes, err := client.GetUserTypes(ctx)
+	if err != nil {
+		return pgdb{}, err
+	}
+
 	builder := squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar)
 	return pgdb{
-		fks:      fks,
-		pkGroups: pkGroups,
-		builder:  builder,
+		fks:       fks,
+		pkGroups:  pkGroups,
+		pkColumns: pkColumns,
+		uniques:   uniques,
+		cycles:    cycles,
+		columns:   columns,
+		inherited: inherited,
+		userTypes: userTypes,
+		builder:   builder,
 	}, nil
 }
 
 type pgdb struct {
 	// figured out from schema
 	pkGroups map[string]getPrimaryKeysRow
-	fks      []ForeignKey
+	// the primary key columns of every table, including composite keys, in key order
+	pkColumns map[string][]string
+	fks       []ForeignKey
+	uniques   map[string][]string
+	// foreign keys that are patched after inserting, to break cycles between tables
+	cycles map[ForeignKey]getForeignKeyOptionsRow
+	// the attributes of every column, by table and column
+	columns map[string]map[string]getColumnsRow
+	// tables that other tables inherit from, whose own rows are read with ONLY.
+	// partitioned tables aren't included, as their rows are read and written through the parent.
+	inherited map[string]bool
+	// the enum, domain and composite types of the database
+	userTypes []getUserTypesRow
 
 	// squirrel instance to help with stuff
 	builder squirrel.StatementBuilderType
@@ -64,6 +133,24 @@ func (db pgdb) PrimaryKeys() map[string]string {
 	return out
 }
 
+// Schema describes the tables of the database, to record along with a dump in WriteDump and check with CheckSchema.
+func (db pgdb) Schema() Schema {
+	schema := Schema{Tables: make(map[string]SchemaTable, len(db.columns)), ForeignKeys: append([]ForeignKey{}, db.fks...)}
+	sortForeignKeys(schema.ForeignKeys)
+	for table, cols := range db.columns {
+		t := SchemaTable{Columns: make(map[string]SchemaColumn, len(cols)), PrimaryKey: db.pkColumns[table]}
+		for col, c := range cols {
+			t.Columns[col] = SchemaColumn{
+				Type:       c.ColumnType,
+				Nullable:   c.Nullable,
+				HasDefault: c.Default != nil || c.Generated != "" || c.Identity != "",
+			}
+		}
+		schema.Tables[table] = t
+	}
+	return schema
+}
+
 type pgtx struct {
 	pgdb
 	ctx context.Context
@@ -71,41 +158,186 @@ type pgtx struct {
 	// as a destination, we need a tx
 	tx postgresQueries
 
+	// as a destination without temporary tables, the mapping created by each Insert
+	mapping *memoryMapping
+
 	// as a source, we must not return already-found objects
-	found          map[string][]any
-	foundWithoutPK map[any]bool
+	// rows are keyed by table and primary key, or by their json when the table has no primary key
+	found KeySet
+
+	// as a destination, whether to load rows with COPY instead of batched inserts
+	bulkCopy bool
+	// as a destination, whether to keep the original primary keys instead of generating new ones
+	preserveIDs bool
+	// as a destination, how to handle rows that already exist, by table
+	matches map[string]matchExisting
+	// as a destination, how to handle references to rows outside the dump, by "table.column"
+	references map[string]ReferencePolicy
+	// as a destination, how to rewrite unique columns, by "table.column", with "" for every other unique column
+	rewrites map[string]UniqueRewrite
+	// as a destination, the session to save the mapping under, if it should outlive the transaction
+	session string
+	// as a destination, called with the progress of each Insert
+	progress func(UploadProgress)
+	// as a destination, how many rows to upload at a time, or 0 to upload every row at once
+	chunkSize int
+	// as a destination, whether to insert with session_replication_role set to replica
+	bypassTriggers bool
+	// as a destination, the triggers to disable while inserting, by table
+	disabledTriggers map[string][]string
+}
+
+// ClientOpt is a functional option that can be passed to NewBatchClient.
+type ClientOpt func(*pgtx)
+
+// PreserveIDs makes Insert restore rows with their original primary keys, and leave foreign keys as they are.
+// This is meant for restoring a dump into a database that doesn't have those rows, such as an empty one.
+// After inserting, the sequences of serial and identity columns are advanced past the largest value in their table.
+// The mapping still records every row, mapped to itself.
+func PreserveIDs() ClientOpt {
+	return func(db *pgtx) {
+		db.preserveIDs = true
+	}
+}
+
+// MatchAction is what Insert does with a row that matches an existing row.
+type MatchAction string
+
+const (
+	// MatchSkip keeps the existing row as it is, and maps the uploaded row onto it.
+	MatchSkip MatchAction = "skip"
+	// MatchUpdate overwrites the existing row with the uploaded row, and maps the uploaded row onto it.
+	MatchUpdate MatchAction = "update"
+	// MatchFail fails the upload.
+	MatchFail MatchAction = "fail"
+)
+
+type matchExisting struct {
+	columns []string
+	action  MatchAction
+}
+
+// MatchExisting makes Insert look for an existing row of `table` with the same values in `columns`,
+// and handle it according to `action` instead of inserting a duplicate.
+// The columns must have a unique constraint or index, such as a natural key or the primary key.
+// Matched rows are recorded in the mapping, so rows referencing them are remapped onto the existing row.
+// When matching by primary key, rows that don't match are inserted with their original primary key.
+func MatchExisting(table string, columns []string, action MatchAction) ClientOpt {
+	return func(db *pgtx) {
+		if db.matches == nil {
+			db.matches = map[string]matchExisting{}
+		}
+		db.matches[table] = matchExisting{columns: columns, action: action}
+	}
+}
+
+func (m matchExisting) includes(col string) bool {
+	for _, c := range m.columns {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+// onConflict builds the ON CONFLICT clause for an insert of the quoted `keys`.
+func (m matchExisting) onConflict(keys []string, pk string) string {
+	target := make([]string, 0, len(m.columns))
+	for _, col := range m.columns {
+		target = append(target, `"`+col+`"`)
+	}
+	clause := "ON CONFLICT (" + strings.Join(target, ", ") + ")"
+	if m.action != MatchUpdate {
+		return clause + " DO NOTHING"
+	}
+
+	// update everything but the primary key, so RETURNING gives the existing row's id
+	sets := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if k != `"`+pk+`"` {
+			sets = append(sets, k+" = EXCLUDED."+k)
+		}
+	}
+	if len(sets) == 0 {
+		for _, k := range target {
+			sets = append(sets, k+" = EXCLUDED."+k)
+		}
+	}
+	return clause + " DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// FoundKeys tracks the rows that the client has already returned in `set`, instead of in memory.
+// Use a DiskKeySet to keep memory bounded for very large exports.
+func FoundKeys(set KeySet) ClientOpt {
+	return func(db *pgtx) {
+		db.found = set
+	}
 }
 
 // NewBatchClient creates a batching client that can be used as a Database for Upload and Download.
 // it is recommended you pass an open transaction, so you can control committing or rolling it back.
 // This client is optimized for Postgres to use a temporary table "datapasta_clone" which allows
 // the entire upload to be done without any round trips. This table is dropped on commit or rollback.
-func (db pgdb) NewBatchClient(ctx context.Context, tx Postgreser) (pgbatchtx, error) {
+func (db pgdb) NewBatchClient(ctx context.Context, tx Postgreser, opts ...ClientOpt) (pgbatchtx, error) {
 	child := pgtx{
-		pgdb:           db,
-		tx:             postgresQueries{tx},
-		ctx:            ctx,
-		found:          map[string][]any{},
-		foundWithoutPK: map[any]bool{},
+		pgdb:  db,
+		tx:    postgresQueries{tx},
+		ctx:   ctx,
+		found: NewMemoryKeySet(),
+	}
+	for _, o := range opts {
+		o(&child)
 	}
-	return pgbatchtx{pgtx: child}, nil
+	return pgbatchtx{pgtx: child, pending: &[]followupQuery{}}, nil
 }
 
 type pgbatchtx struct {
 	pgtx
+
+	// updates of self-referencing foreign keys that wait for a later chunk to insert the referenced row
+	pending *[]followupQuery
+}
+
+type followupQuery struct {
+	// target is the table and original primary key of the referenced row
+	target string
+	sql    string
+	args   []any
 }
 
-func (db pgbatchtx) SelectMatchingRows(tname string, conds map[string][]any) ([]map[string]any, error) {
-	// build a query to select * where each of the conditions is met
-	or := squirrel.Or{}
-	for col, vals := range conds {
-		or = append(or, squirrel.Eq{col: vals})
+// lookupChunkSize bounds how many values are sent in one `IN (...)` list,
+// keeping each query well under the postgres limit of 65535 parameters.
+const lookupChunkSize = 5000
+
+func (db pgtx) SelectMatchingRows(tname string, conds map[string][]any) ([]map[string]any, error) {
+	cols := make([]string, 0, len(conds))
+	for col := range conds {
+		cols = append(cols, col)
 	}
-	eq := squirrel.Sqlizer(or)
-	if pk, ok := db.pkGroups[tname]; ok {
-		eq = squirrel.And{eq, squirrel.NotEq{pk.ColumnName: db.found[tname]}}
+	sort.Strings(cols)
+
+	// query each column in bounded chunks; rows matching more than one chunk are deduped as found rows
+	foundInThisScan := make(DatabaseDump, 0)
+	for _, col := range cols {
+		vals := conds[col]
+		for start := 0; start < len(vals); start += lookupChunkSize {
+			end := start + lookupChunkSize
+			if end > len(vals) {
+				end = len(vals)
+			}
+			found, err := db.selectChunk(tname, squirrel.Eq{col: vals[start:end]})
+			if err != nil {
+				return nil, err
+			}
+			foundInThisScan = append(foundInThisScan, found...)
+		}
 	}
-	sql, args, err := db.builder.Select("*").From(`"` + tname + `"`).Where(eq).ToSql()
+	return foundInThisScan, nil
+}
+
+// selectChunk selects every row matching `eq`, skipping rows that have already been found.
+func (db pgtx) selectChunk(tname string, eq squirrel.Sqlizer) (DatabaseDump, error) {
+	sql, args, err := db.builder.Select(db.selectColumns(tname)...).From(db.tableRef(tname)).Where(eq).ToSql()
 	if err != nil {
 		return nil, err
 	}
@@ -126,10 +358,7 @@ func (db pgbatchtx) SelectMatchingRows(tname string, conds map[string][]any) ([]
 
 		res := map[string]any{DumpTableKey: tname}
 		for n, field := range desc {
-			res[string(field.Name)] = vals[n]
-			if b, ok := vals[n].([16]byte); ok {
-				res[string(field.Name)] = pgtype.UUID{Bytes: b, Status: pgtype.Present}
-			}
+			res[string(field.Name)] = nativeValue(vals[n])
 
 			if pg, ok := vals[n].(interface {
 				EncodeText(ci *pgtype.ConnInfo, buf []byte) ([]byte, error)
@@ -142,26 +371,56 @@ func (db pgbatchtx) SelectMatchingRows(tname string, conds map[string][]any) ([]
 			}
 		}
 
+		var key string
 		if pk, ok := db.pkGroups[tname]; ok {
-			db.found[tname] = append(db.found[tname], res[pk.ColumnName])
+			key = fmt.Sprintf("%s\x00%v", tname, res[pk.ColumnName])
 		} else {
 			k, _ := json.Marshal(res)
-			resStr := string(k)
-			if _, found := db.foundWithoutPK[resStr]; found {
-				continue
-			}
-			db.foundWithoutPK[resStr] = true
+			key = string(k)
+		}
+		if added, err := db.found.Add(key); err != nil {
+			return nil, err
+		} else if !added {
+			continue
 		}
 		foundInThisScan = append(foundInThisScan, res)
 	}
-	return foundInThisScan, nil
+	return foundInThisScan, rows.Err()
+}
+
+func (db pgtx) InsertRecord(row map[string]any) (any, error) {
+	pks, err := db.keyColumns(row[DumpTableKey].(string))
+	if err != nil {
+		return nil, err
+	}
+	returning := make([]string, len(pks))
+	for i, pk := range pks {
+		returning[i] = `"` + pk + `"`
+	}
+	sql, args, err := db.insertStatement(row, func([]string) string { return "RETURNING " + strings.Join(returning, ", ") })
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]any, len(pks))
+	dest := make([]any, len(pks))
+	for i := range ids {
+		dest[i] = &ids[i]
+	}
+	if err := db.tx.db.QueryRow(db.ctx, sql, args...).Scan(dest...); err != nil {
+		return nil, err
+	}
+	if len(ids) == 1 {
+		return ids[0], nil
+	}
+	return ids, nil
 }
 
-func (db pgbatchtx) InsertRecord(row map[string]any) (any, error) {
+// insertStatement builds the insert of the non-nil values of `row` into its table, followed by the suffix for its columns.
+func (db pgtx) insertStatement(row map[string]any, suffix func(keys []string) string) (string, []any, error) {
+	table := row[DumpTableKey].(string)
 	keys := make([]string, 0, len(row))
 	vals := make([]any, 0, len(row))
-	table := row[DumpTableKey].(string)
-	builder := db.builder.Insert(`"` + table + `"`).Suffix("RETURNING id")
+	overriding := false
 	for k, v := range row {
 		if v == nil {
 			continue
@@ -169,26 +428,51 @@ func (db pgbatchtx) InsertRecord(row map[string]any) (any, error) {
 		if k == DumpTableKey {
 			continue
 		}
+		// every given value is kept, so only generated columns are left out
+		write, override := db.writable(table, k, k)
+		if !write {
+			continue
+		}
+		overriding = overriding || override
 		keys = append(keys, fmt.Sprintf(`"%s"`, k))
-		vals = append(vals, v)
+		vals = append(vals, db.castValue(table, k, v))
 	}
 
-	builder = builder.Columns(keys...).Values(vals...)
+	builder := db.builder.Insert(`"` + table + `"`).Columns(keys...).Values(vals...)
+	if s := suffix(keys); s != "" {
+		builder = builder.Suffix(s)
+	}
 	sql, args, err := builder.ToSql()
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	var id any
-	if err := db.tx.db.QueryRow(db.ctx, sql, args...).Scan(&id); err != nil {
-		return nil, err
+	if overriding {
+		sql = strings.Replace(sql, ") VALUES (", ") OVERRIDING SYSTEM VALUE VALUES (", 1)
+	} else if len(keys) == 0 {
+		// rows with only a new primary key use every default
+		sql = strings.Replace(sql, " VALUES ()", " DEFAULT VALUES", 1)
 	}
-	return id, nil
+	return sql, args, nil
 }
 
-func (db pgbatchtx) Update(id RecordID, cols map[string]any) error {
+func (db pgtx) Update(id RecordID, cols map[string]any) error {
 	table := id.Table
-	builder := db.builder.Update(`"` + table + `"`)
-	builder = builder.SetMap(cols).Where(squirrel.Eq{"id": id.PrimaryKey})
+	builder := db.builder.Update(db.tableRef(table))
+	set := make(map[string]any, len(cols))
+	for k, v := range cols {
+		// generated columns and GENERATED ALWAYS identities can't be updated
+		if c := db.columns[table][k]; c.Generated == "" && c.Identity != "a" {
+			set[k] = db.castValue(table, k, v)
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	where, err := db.whereKey(id)
+	if err != nil {
+		return err
+	}
+	builder = builder.SetMap(set).Where(where)
 	sql, args, err := builder.ToSql()
 	if err != nil {
 		return err
@@ -203,9 +487,12 @@ func (db pgbatchtx) Update(id RecordID, cols map[string]any) error {
 	return nil
 }
 
-func (db pgbatchtx) Delete(id RecordID) error {
-	table := id.Table
-	builder := db.builder.Delete(`"` + table + `"`).Where(squirrel.Eq{"id": id.PrimaryKey})
+func (db pgtx) Delete(id RecordID) error {
+	where, err := db.whereKey(id)
+	if err != nil {
+		return err
+	}
+	builder := db.builder.Delete(db.tableRef(id.Table)).Where(where)
 	sql, args, err := builder.ToSql()
 	if err != nil {
 		return err
@@ -220,33 +507,275 @@ func (db pgbatchtx) Delete(id RecordID) error {
 	return nil
 }
 
+// tableRef quotes `table` to read, update or delete its own rows, leaving out the rows of tables that inherit from it.
+func (db pgdb) tableRef(table string) string {
+	if db.inherited[table] {
+		return `ONLY "` + table + `"`
+	}
+	return `"` + table + `"`
+}
+
+// keyColumns returns the primary key columns of `table`, in key order.
+func (db pgdb) keyColumns(table string) ([]string, error) {
+	if cols, ok := db.pkColumns[table]; ok && len(cols) > 0 {
+		return cols, nil
+	}
+	if pk, ok := db.pkGroups[table]; ok {
+		return []string{pk.ColumnName}, nil
+	}
+	return nil, fmt.Errorf("no primary key for %s", table)
+}
+
+// whereKey matches the row identified by `id`.
+// A composite primary key is given either as a []any in key order, as InsertRecord returns it, or as a map by column.
+func (db pgdb) whereKey(id RecordID) (squirrel.Eq, error) {
+	pks, err := db.keyColumns(id.Table)
+	if err != nil {
+		return nil, err
+	}
+	if len(pks) == 1 {
+		return squirrel.Eq{`"` + pks[0] + `"`: id.PrimaryKey}, nil
+	}
+
+	where := make(squirrel.Eq, len(pks))
+	switch key := id.PrimaryKey.(type) {
+	case []any:
+		if len(key) != len(pks) {
+			return nil, fmt.Errorf("%s has a primary key of %d columns, but %d values were given", id.Table, len(pks), len(key))
+		}
+		for i, pk := range pks {
+			where[`"`+pk+`"`] = key[i]
+		}
+	case map[string]any:
+		for _, pk := range pks {
+			v, ok := key[pk]
+			if !ok {
+				return nil, fmt.Errorf("missing primary key column %s.%s", id.Table, pk)
+			}
+			where[`"`+pk+`"`] = v
+		}
+	default:
+		return nil, fmt.Errorf("%s has a composite primary key, which must be given as a []any or map[string]any, not %T", id.Table, id.PrimaryKey)
+	}
+	return where, nil
+}
+
+// Mapping returns the primary keys created by prior Inserts, typed as each table's primary key column.
 func (db pgbatchtx) Mapping() ([]Mapping, error) {
-	rows, err := db.tx.GetMapping(db.ctx)
+	tables, err := db.tx.GetMappedTables(db.ctx)
 	if err != nil {
 		return nil, err
 	}
-	mapps := make([]Mapping, 0, len(rows))
-	for _, r := range rows {
-		mapps = append(mapps, Mapping{RecordID: RecordID{Table: r.TableName, PrimaryKey: r.CloneID}, OriginalID: r.OriginalID})
+	mapps := make([]Mapping, 0)
+	for _, table := range tables {
+		pk, ok := db.pkGroups[table]
+		if !ok {
+			return nil, fmt.Errorf("no primary key for mapped table %s", table)
+		}
+		rows, err := db.tx.GetMapping(db.ctx, table, pk.ColumnType)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			mapps = append(mapps, Mapping{RecordID: RecordID{Table: table, PrimaryKey: r.CloneID}, OriginalID: r.OriginalID})
+		}
 	}
 	return mapps, nil
 }
 
+// clonesOf returns the clones of the rows referenced by `rows` that earlier inserts mapped, by the table and original
+// primary key of each referenced row. Only those rows are loaded, so that each chunk of a large upload reads
+// a bounded part of the mapping.
+func (db pgbatchtx) clonesOf(rows []map[string]any) (map[string]any, error) {
+	ids := map[string]map[string]bool{}
+	for _, row := range rows {
+		for _, fk := range db.fks {
+			v := row[fk.ReferencingCol]
+			if fk.ReferencingTable != row[DumpTableKey] || v == nil {
+				continue
+			}
+			if _, ok := db.pkGroups[fk.BaseTable]; !ok {
+				continue
+			}
+			if ids[fk.BaseTable] == nil {
+				ids[fk.BaseTable] = map[string]bool{}
+			}
+			ids[fk.BaseTable][textValue(v)] = true
+		}
+	}
+
+	clones := make(map[string]any, len(rows))
+	for _, table := range sortedKeys(ids) {
+		mapped, err := db.tx.GetClones(db.ctx, table, db.pkGroups[table].ColumnType, sortedKeys(ids[table]))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range mapped {
+			clones[table+"\x00"+m.OriginalID.(string)] = m.CloneID
+		}
+	}
+	return clones, nil
+}
+
+// createMapping creates the temporary table that maps original primary keys to cloned ones, if it doesn't exist yet.
+// keys are stored as text, and cast to and from each table's primary key type.
+func (db pgbatchtx) createMapping() error {
+	if _, err := db.tx.db.Exec(db.ctx, "CREATE TEMPORARY TABLE IF NOT EXISTS datapasta_clone(table_name text, original_id text, clone_id text) ON COMMIT DROP"); err != nil {
+		return err
+	}
+
+	if _, err := db.tx.db.Exec(db.ctx, "CREATE INDEX IF NOT EXISTS datapasta_clone_idx ON datapasta_clone(table_name, original_id)"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// advanceSequences moves the sequences of each table's serial and identity columns past the largest value in the table,
+// so that rows inserted with their original values don't collide with rows inserted later.
+// Sequences are never moved backwards.
+func (db pgtx) advanceSequences(rows []map[string]any) error {
+	seen := map[string]bool{}
+	for _, row := range rows {
+		table := row[DumpTableKey].(string)
+		if seen[table] {
+			continue
+		}
+		seen[table] = true
+
+		for _, col := range db.sequenceColumns(table) {
+			sql := `SELECT setval(s, GREATEST((SELECT max("` + col + `") FROM "` + table + `"), pg_sequence_last_value(s::regclass)))
+				FROM pg_get_serial_sequence($1, $2) s WHERE s IS NOT NULL`
+			if _, err := db.tx.db.Exec(db.ctx, sql, `"`+table+`"`, col); err != nil {
+				return fmt.Errorf("advancing sequence for %s.%s: %w", table, col, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sequenceColumns returns the integer columns of `table` that are filled from a sequence,
+// which are identity columns and columns defaulting to nextval(...), such as serial columns.
+func (db pgdb) sequenceColumns(table string) []string {
+	var cols []string
+	for _, col := range sortedKeys(db.columns[table]) {
+		c := db.columns[table][col]
+		switch c.ColumnType {
+		case "smallint", "integer", "bigint":
+		default:
+			continue
+		}
+		if c.Identity != "" || (c.Default != nil && strings.HasPrefix(*c.Default, "nextval(")) {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// writable reports whether a value can be inserted into `table`.`col`, and whether that needs OVERRIDING SYSTEM VALUE.
+// Generated columns are always computed by postgres. GENERATED ALWAYS identity columns are only written when
+// they're the primary key being kept, or when restoring with PreserveIDs; otherwise postgres generates them.
+func (db pgtx) writable(table, col, pk string) (write, override bool) {
+	c := db.columns[table][col]
+	if c.Generated != "" {
+		return false, false
+	}
+	if c.Identity == "a" {
+		if col != pk && !db.preserveIDs {
+			return false, false
+		}
+		return true, true
+	}
+	return true, false
+}
+
+// cloneOf returns an expression for the cloned primary key of the row of `table` that originally had primary key `id`.
+// It is NULL if the row hasn't been cloned.
+func (db pgdb) cloneOf(table string, id any) squirrel.Sqlizer {
+	typ := db.pkGroups[table].ColumnType
+	return squirrel.Expr("(SELECT clone_id::"+typ+" FROM datapasta_clone WHERE original_id = (?::"+typ+")::text AND table_name = ?::text)", id, table)
+}
+
 func (db pgbatchtx) Insert(rows ...map[string]any) error {
-	if _, err := db.tx.db.Exec(db.ctx, "CREATE TEMPORARY TABLE IF NOT EXISTS datapasta_clone(table_name text, original_id integer, clone_id integer) ON COMMIT DROP"); err != nil {
+	if err := db.createMapping(); err != nil {
 		return err
 	}
+	return db.withoutTriggers(func() error { return db.insertRows(rows) })
+}
 
-	if _, err := db.tx.db.Exec(db.ctx, "CREATE INDEX ON datapasta_clone(table_name,original_id, clone_id)"); err != nil {
+func (db pgbatchtx) insertRows(rows []map[string]any) error {
+	resolved, err := db.resolvedKeys(rows)
+	if err != nil {
 		return err
 	}
+	progress := db.newProgress(len(rows))
 
+	if db.chunkSize <= 0 || len(rows) <= db.chunkSize {
+		if err := db.insertChunk(rows, resolved, nil, progress); err != nil {
+			return err
+		}
+	} else {
+		// fail before the first chunk is inserted if any chunk has references that can't be resolved
+		if err := db.checkReferences(rows, resolved); err != nil {
+			return err
+		}
+		later := db.patchTargets(rows)
+		for start := 0; start < len(rows); start += db.chunkSize {
+			end := start + db.chunkSize
+			if end > len(rows) {
+				end = len(rows)
+			}
+			chunk := rows[start:end]
+			for _, row := range chunk {
+				delete(later, db.rowKey(row))
+			}
+			if err := db.savepoint(func() error { return db.insertChunk(chunk, resolved, later, progress) }); err != nil {
+				return ChunkError{Offset: start, Err: err}
+			}
+		}
+	}
+
+	if db.preserveIDs {
+		if err := db.advanceSequences(rows); err != nil {
+			return err
+		}
+	}
+
+	progress.done()
+	return nil
+}
+
+// insertChunk inserts `rows`, and persists their mapping along with them, so that chunks that were inserted
+// before a failed one stay mapped when the upload is resumed.
+func (db pgbatchtx) insertChunk(rows []map[string]any, resolved, later map[string]bool, progress *uploadProgress) error {
+	insert := db.batchInsert
+	if db.bulkCopy {
+		insert = db.copyInsert
+	}
+	if err := insert(rows, resolved, later, progress); err != nil {
+		return err
+	}
+	return db.persistMapping(rows)
+}
+
+// batchInsert sends one batch of inserts for `rows`, followed by a batch of the updates that patch self-referencing
+// foreign keys. Updates that reference rows in `later` are kept pending until a later chunk inserts those rows.
+func (db pgbatchtx) batchInsert(rows []map[string]any, resolved, later map[string]bool, progress *uploadProgress) error {
 	start := time.Now()
 
 	batch := &pgx.Batch{}
-	followup := &pgx.Batch{}
+	followups := []followupQuery{}
+	// queuedTables has the table of each batch query
+	queuedTables := make([]string, 0, len(rows))
+	// checks has the error to return for each batch query that must affect a row
+	checks := map[int]string{}
+	// deferConstraints are the constraints of NOT NULL columns that are patched after inserting
+	deferConstraints := map[string]bool{}
+	unresolved := UnresolvedReferencesError{}
 	for _, row := range rows {
 		table := row[DumpTableKey].(string)
+		if err := db.rewriteUniques(row); err != nil {
+			return err
+		}
 
 		pk := ""
 		if pkg, found := db.pkGroups[table]; found {
@@ -255,15 +784,12 @@ func (db pgbatchtx) Insert(rows ...map[string]any) error {
 
 		builder := db.builder.Insert(`"` + table + `"`)
 		oldPK := row[pk]
-		if pk != "" {
-			builder = builder.Suffix("RETURNING " + pk + " as id")
-			builder = builder.Prefix("WITH inserted_row AS (")
-			builder = builder.Suffix(") INSERT INTO datapasta_clone (table_name, original_id, clone_id) SELECT ?, ?, id FROM inserted_row", table, oldPK)
-			//delete(row, pk)
-		}
+		match, matching := db.matches[table]
 
 		keys := make([]string, 0, len(row))
 		vals := make([]any, 0, len(row))
+		valueOf := make(map[string]any, len(row))
+		overriding := false
 		for k, v := range row {
 			if v == nil {
 				continue
@@ -272,59 +798,119 @@ func (db pgbatchtx) Insert(rows ...map[string]any) error {
 				continue
 			}
 			deferred := false
-			foundForeign := false
-			for _, fk := range db.fks {
-
-				if fk.ReferencingCol == k && fk.ReferencingTable == table {
-					foundForeign = true
-					findInMap := squirrel.Expr("COALESCE((SELECT clone_id FROM datapasta_clone WHERE original_id = ? AND table_name = ?::text), ?)", v, fk.BaseTable, v)
-
-					if fk.BaseTable == table {
-						// self-referential columns become NULL and are updated in a second pass by PK
-						if pk == "" {
-							return fmt.Errorf("can't have self-referencing tables without primary key")
-						}
-						deferred = true
-						builder := db.builder.Update(`"`+table+`"`).Set(k, findInMap).Where(pk+"=(SELECT clone_id FROM datapasta_clone WHERE original_id = ? AND table_name = ?::text)", oldPK, fk.BaseTable)
-						sql, args, err := builder.ToSql()
-						if err != nil {
-							return fmt.Errorf(`build: %w, args: %s, sql: %s`, err, args, sql)
-						}
-						followup.Queue(sql, args...)
-					} else {
-						v = findInMap
-					}
+			fk, v, foundForeign, mapped := db.foreignValue(row, k, v, resolved, &unresolved)
+			if mapped {
+				var findInMap any = squirrel.Expr("COALESCE(?, ?)", db.cloneOf(fk.BaseTable, v), v)
+				if db.preserveIDs {
+					// restored rows keep their original references
+					findInMap = v
+				}
 
-					break
+				if _, inCycle := db.cycles[fk]; fk.BaseTable == table || inCycle {
+					// self-referential columns, and columns that close a cycle between tables,
+					// become NULL and are updated in a second pass by PK
+					keep, guard, err := db.patchedReference(table, pk, k, fk, v, matching && match.action == MatchSkip, deferConstraints)
+					if err != nil {
+						return err
+					}
+					deferred = !keep
+					where := squirrel.And{squirrel.Expr(pk+" = ?", db.cloneOf(table, oldPK))}
+					if guard != nil {
+						where = append(where, guard)
+					}
+					builder := db.builder.Update(`"`+table+`"`).Set(k, findInMap).Where(where)
+					sql, args, err := builder.ToSql()
+					if err != nil {
+						return fmt.Errorf(`build: %w, args: %s, sql: %s`, err, args, sql)
+					}
+					followups = append(followups, followupQuery{target: fk.BaseTable + "\x00" + textValue(v), sql: sql, args: args})
+				} else {
+					v = findInMap
 				}
 			}
 			if deferred {
 				continue
 			}
-			if foundForeign || k != pk {
+			if foundForeign || k != pk || db.preserveIDs || (matching && match.includes(k)) {
+				write, override := db.writable(table, k, pk)
+				if !write {
+					continue
+				}
+				overriding = overriding || override
 				keys = append(keys, fmt.Sprintf(`"%s"`, k))
-				vals = append(vals, v)
+				vals = append(vals, db.castValue(table, k, v))
+				valueOf[k] = v
 			}
 		}
 
 		builder = builder.Columns(keys...).Values(vals...)
+		if matching {
+			builder = builder.Suffix(match.onConflict(keys, pk))
+			if match.action == MatchFail {
+				checks[batch.Len()] = fmt.Sprintf("%s(%v) matches an existing row", table, oldPK)
+			}
+		}
+		if pk != "" {
+			builder = builder.Suffix("RETURNING " + pk + " as id")
+			builder = builder.Prefix("WITH inserted_row AS (")
+			builder = builder.Suffix(") INSERT INTO datapasta_clone (table_name, original_id, clone_id) SELECT ?, (?::"+db.pkGroups[table].ColumnType+")::text, id::text FROM inserted_row", table, oldPK)
+			//delete(row, pk)
+
+			if matching && match.action == MatchSkip {
+				// the existing row is only visible to this statement if it existed before the insert
+				existing := squirrel.And{}
+				for _, col := range match.columns {
+					existing = append(existing, squirrel.Expr(`"`+col+`" = ?`, valueOf[col]))
+				}
+				builder = builder.Suffix("UNION ALL SELECT ?, (?::"+db.pkGroups[table].ColumnType+")::text, "+pk+"::text FROM \""+table+"\" WHERE ? AND NOT EXISTS (SELECT 1 FROM inserted_row)", table, oldPK, existing)
+			}
+		}
+
 		sql, args, err := builder.ToSql()
 		if err != nil {
 			return fmt.Errorf(`build: %w, args: %s, sql: %s`, err, args, sql)
 		}
+		if overriding {
+			// squirrel can't build this clause, and it must come right before VALUES
+			sql = strings.Replace(sql, ") VALUES (", ") OVERRIDING SYSTEM VALUE VALUES (", 1)
+		} else if len(keys) == 0 {
+			// rows with only a new primary key use every default
+			sql = strings.Replace(sql, " VALUES ()", " DEFAULT VALUES", 1)
+		}
 
 		batch.Queue(sql, args...)
+		queuedTables = append(queuedTables, table)
+		progress.queued()
 	}
 
+	if len(unresolved.References) > 0 {
+		return unresolved
+	}
+
+	followup, pending := db.readyFollowups(followups, later)
+
 	prepped := time.Now()
 	LogFunc("batchrows:%d, followups:%d", batch.Len(), followup.Len())
+	progress.FollowupsQueued += followup.Len()
+	progress.send(false, 0)
+
+	if err := db.deferConstraints(deferConstraints); err != nil {
+		return err
+	}
 
 	res := db.tx.db.SendBatch(db.ctx, batch)
 	for i := 0; i < batch.Len(); i++ {
-		_, err := res.Exec()
+		cmd, err := res.Exec()
 		if err != nil {
+			// the batch must be closed before anything else is sent, such as the rollback to a chunk's savepoint
+			res.Close()
 			return fmt.Errorf(`batch query %d error: %w`, i, err)
 		}
+		if msg, ok := checks[i]; ok && cmd.RowsAffected() == 0 {
+			res.Close()
+			return fmt.Errorf(`batch query %d error: %s`, i, msg)
+		}
+		progress.executed(queuedTables[i], 1)
 	}
 	if err := res.Close(); err != nil {
 		return fmt.Errorf("failed to execute batch upload: %w", err)
@@ -334,17 +920,50 @@ func (db pgbatchtx) Insert(rows ...map[string]any) error {
 	for i := 0; i < followup.Len(); i++ {
 		_, err := fks.Exec()
 		if err != nil {
+			fks.Close()
 			return fmt.Errorf(`batch foreign key %d error: %w`, i, err)
 		}
+		progress.followedUp()
 	}
-	fks.Close()
+	if err := fks.Close(); err != nil {
+		return fmt.Errorf("failed to execute batch followup queries: %w", err)
+	}
+	*db.pending = pending
 
 	LogFunc("prepping: %s, batching: %s", prepped.Sub(start), time.Since(prepped))
+	return nil
+}
 
-	if err := res.Close(); err != nil {
-		return fmt.Errorf("failed to execute batch followup queries: %w", err)
+// Beginner can open transactions.
+// github.com/jackc/pgx/v4/pgxpool.Pool and github.com/jackc/pgx/v4.Conn are such implementations.
+type Beginner interface {
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+}
+
+// BeginSnapshot opens a REPEATABLE READ, READ ONLY transaction that can be passed to NewBatchClient,
+// so that every query of a Download sees one consistent snapshot of the database.
+// If `snapshotID` is empty, a new snapshot is exported and its id is returned. Passing that id to BeginSnapshot
+// on other connections lets parallel downloads share the exact same snapshot, for as long as the first transaction is open.
+func BeginSnapshot(ctx context.Context, conn Beginner, snapshotID string) (pgx.Tx, string, error) {
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, "", err
 	}
-	return nil
+
+	if snapshotID != "" {
+		// SET TRANSACTION SNAPSHOT doesn't accept parameters
+		if _, err := tx.Exec(ctx, "SET TRANSACTION SNAPSHOT '"+strings.ReplaceAll(snapshotID, "'", "''")+"'"); err != nil {
+			tx.Rollback(ctx)
+			return nil, "", fmt.Errorf("importing snapshot %s: %w", snapshotID, err)
+		}
+		return tx, snapshotID, nil
+	}
+
+	if err := tx.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&snapshotID); err != nil {
+		tx.Rollback(ctx)
+		return nil, "", fmt.Errorf("exporting snapshot: %w", err)
+	}
+	return tx, snapshotID, nil
 }
 
 // Postgreser does postgres things.
@@ -361,32 +980,108 @@ type postgresQueries struct {
 	db Postgreser
 }
 
+const getMappedTables = `
+	SELECT DISTINCT table_name FROM datapasta_clone ORDER BY table_name
+`
+
+func (q *postgresQueries) GetMappedTables(ctx context.Context) ([]string, error) {
+	rows, err := q.db.Query(ctx, getMappedTables)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var i string
+		if err := rows.Scan(&i); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getInheritedTables = `-- name: GetInheritedTables :many
+SELECT DISTINCT p.relname::text AS table_name
+FROM pg_catalog.pg_inherits i
+	JOIN pg_catalog.pg_class p ON p.oid = i.inhparent
+	JOIN pg_catalog.pg_namespace n ON n.oid = p.relnamespace
+WHERE
+	p.relkind = 'r'
+	AND n.nspname NOT IN ('pg_catalog', 'pg_toast', 'information_schema')
+	AND pg_catalog.pg_table_is_visible(p.oid)
+`
+
+func (q *postgresQueries) GetInheritedTables(ctx context.Context) ([]string, error) {
+	rows, err := q.db.Query(ctx, getInheritedTables)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var i string
+		if err := rows.Scan(&i); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// getMapping is formatted with the type of the table's primary key
 const getMapping = `
-	SELECT table_name, original_id, clone_id FROM datapasta_clone
+	SELECT original_id::%[1]s, clone_id::%[1]s FROM datapasta_clone WHERE table_name = $1
+`
+
+// getClones is formatted with the type of the table's primary key
+const getClones = `
+	SELECT original_id, clone_id::%s FROM datapasta_clone WHERE table_name = $1 AND original_id = ANY($2::text[])
 `
 
+func (q *postgresQueries) GetClones(ctx context.Context, table, columnType string, originalIDs []string) ([]getMappingRow, error) {
+	rows, err := q.db.Query(ctx, fmt.Sprintf(getClones, columnType), table, originalIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []getMappingRow
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, getMappingRow{OriginalID: vals[0], CloneID: nativeValue(vals[1])})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 type getMappingRow struct {
-	TableName           string
-	OriginalID, CloneID int32
+	OriginalID, CloneID any
 }
 
-func (q *postgresQueries) GetMapping(ctx context.Context) ([]getMappingRow, error) {
-	rows, err := q.db.Query(ctx, getMapping)
+func (q *postgresQueries) GetMapping(ctx context.Context, table, columnType string) ([]getMappingRow, error) {
+	rows, err := q.db.Query(ctx, fmt.Sprintf(getMapping, columnType), table)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var items []getMappingRow
 	for rows.Next() {
-		var i getMappingRow
-		if err := rows.Scan(
-			&i.TableName,
-			&i.OriginalID,
-			&i.CloneID,
-		); err != nil {
+		vals, err := rows.Values()
+		if err != nil {
 			return nil, err
 		}
-		items = append(items, i)
+		items = append(items, getMappingRow{OriginalID: nativeValue(vals[0]), CloneID: nativeValue(vals[1])})
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -394,6 +1089,30 @@ func (q *postgresQueries) GetMapping(ctx context.Context) ([]getMappingRow, erro
 	return items, nil
 }
 
+// nativeValue converts values scanned by pgx into the types used in a DatabaseDump.
+func nativeValue(v any) any {
+	if b, ok := v.([16]byte); ok {
+		return pgtype.UUID{Bytes: b, Status: pgtype.Present}
+	}
+	return v
+}
+
+// textValue formats a value the same way postgres casts it to text, so it can be compared with the mapping.
+func textValue(v any) string {
+	if pg, ok := v.(interface {
+		EncodeText(ci *pgtype.ConnInfo, buf []byte) ([]byte, error)
+	}); ok {
+		if out, err := pg.EncodeText(nil, nil); err == nil {
+			return string(out)
+		}
+	}
+	// %v would format large whole numbers, such as 1000000, as 1e+06
+	if f, ok := v.(float64); ok && f == math.Trunc(f) && !math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprintf(`%v`, v)
+}
+
 const getForeignKeys = `-- name: GetForeignKeys :many
 SELECT 
 	(select  r.relname from pg_catalog.pg_class r where r.oid = c.confrelid)::text as base_table,
@@ -401,6 +1120,7 @@ SELECT
    	(select r.relname from pg_catalog.pg_class r where r.oid = c.conrelid)::text as referencing_table,
    	UNNEST((select array_agg(attname) from pg_catalog.pg_attribute where attrelid = c.conrelid and array[attnum] <@ c.conkey))::text as referencing_col
 FROM pg_catalog.pg_constraint c join pg_catalog.pg_attribute a on c.confrelid=a.attrelid and a.attnum = ANY(confkey)
+WHERE c.conparentid = 0
 `
 
 type getForeignKeysRow struct {
@@ -435,10 +1155,124 @@ func (q *postgresQueries) GetForeignKeys(ctx context.Context) ([]getForeignKeysR
 	return items, nil
 }
 
+const getForeignKeyOptions = `-- name: GetForeignKeyOptions :many
+SELECT
+	(select r.relname from pg_catalog.pg_class r where r.oid = c.conrelid)::text as referencing_table,
+	a.attname::text as referencing_col,
+	c.conname::text as constraint_name,
+	c.condeferrable as deferrable,
+	NOT a.attnotnull as nullable
+FROM pg_catalog.pg_constraint c join pg_catalog.pg_attribute a on c.conrelid=a.attrelid and a.attnum = ANY(c.conkey)
+WHERE c.contype = 'f' AND c.conparentid = 0
+`
+
+type getForeignKeyOptionsRow struct {
+	ReferencingTable string `json:"referencing_table"`
+	ReferencingCol   string `json:"referencing_col"`
+	ConstraintName   string `json:"constraint_name"`
+	Deferrable       bool   `json:"deferrable"`
+	Nullable         bool   `json:"nullable"`
+}
+
+func (q *postgresQueries) GetForeignKeyOptions(ctx context.Context) ([]getForeignKeyOptionsRow, error) {
+	rows, err := q.db.Query(ctx, getForeignKeyOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []getForeignKeyOptionsRow
+	for rows.Next() {
+		var i getForeignKeyOptionsRow
+		if err := rows.Scan(
+			&i.ReferencingTable,
+			&i.ReferencingCol,
+			&i.ConstraintName,
+			&i.Deferrable,
+			&i.Nullable,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getColumns = `-- name: GetColumns :many
+SELECT
+	c.relname::text AS table_name,
+	a.attname::text AS column_name,
+	format_type(a.atttypid, a.atttypmod)::text AS column_type,
+	NOT a.attnotnull AS nullable,
+	a.attgenerated::text AS generated,
+	a.attidentity::text AS identity,
+	pg_get_expr(d.adbin, d.adrelid)::text AS column_default,
+	(t.typtype IN ('e', 'c') OR COALESCE(et.typtype IN ('e', 'c'), false)) AS user_defined
+FROM pg_catalog.pg_attribute a
+	JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+	JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+	JOIN pg_catalog.pg_type t ON t.oid = a.atttypid
+	LEFT JOIN pg_catalog.pg_type et ON et.oid = t.typelem AND t.typcategory = 'A'
+	LEFT JOIN pg_catalog.pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+WHERE
+	a.attnum > 0 AND NOT a.attisdropped
+	AND c.relkind IN ('r', 'p') AND NOT c.relispartition
+	AND n.nspname NOT IN ('pg_catalog', 'pg_toast', 'information_schema')
+	AND pg_catalog.pg_table_is_visible(c.oid)
+ORDER BY c.relname, a.attnum
+`
+
+type getColumnsRow struct {
+	TableName  string `json:"table_name"`
+	ColumnName string `json:"column_name"`
+	ColumnType string `json:"column_type"`
+	Nullable   bool   `json:"nullable"`
+	// Generated is "s" for GENERATED ALWAYS AS (...) STORED columns
+	Generated string `json:"generated"`
+	// Identity is "a" for GENERATED ALWAYS AS IDENTITY columns, and "d" for GENERATED BY DEFAULT AS IDENTITY columns
+	Identity string  `json:"identity"`
+	Default  *string `json:"column_default"`
+	// UserDefined is set for enum and composite types, and arrays of them.
+	// Domains aren't included, as pgx reads and writes them like their base type.
+	UserDefined bool `json:"user_defined"`
+}
+
+func (q *postgresQueries) GetColumns(ctx context.Context) ([]getColumnsRow, error) {
+	rows, err := q.db.Query(ctx, getColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []getColumnsRow
+	for rows.Next() {
+		var i getColumnsRow
+		if err := rows.Scan(
+			&i.TableName,
+			&i.ColumnName,
+			&i.ColumnType,
+			&i.Nullable,
+			&i.Generated,
+			&i.Identity,
+			&i.Default,
+			&i.UserDefined,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getPrimaryKeys = `-- name: GetPrimaryKeys :many
 select
     t.relname::text  as table_name,
-    (ARRAY_AGG(a.attname::text))[1]::text AS column_name
+    (ARRAY_AGG(a.attname::text))[1]::text AS column_name,
+    (ARRAY_AGG(format_type(a.atttypid, a.atttypmod)))[1]::text AS column_type
 from
           pg_catalog.pg_class c
      join pg_catalog.pg_namespace n on n.oid        = c.relnamespace
@@ -446,7 +1280,8 @@ from
      join pg_catalog.pg_class t     on i.indrelid   = t.oid
      JOIN   pg_catalog.pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
 where
-        c.relkind = 'i'
+        c.relkind in ('i', 'I')
+    and not t.relispartition
     and n.nspname not in ('pg_catalog', 'pg_toast')
     and pg_catalog.pg_table_is_visible(c.oid)
 GROUP BY t.relname
@@ -456,6 +1291,7 @@ HAVING COUNT(*) = 1
 type getPrimaryKeysRow struct {
 	TableName  string `json:"table_name"`
 	ColumnName string `json:"column_name"`
+	ColumnType string `json:"column_type"`
 }
 
 func (q *postgresQueries) GetPrimaryKeys(ctx context.Context) ([]getPrimaryKeysRow, error) {
@@ -467,7 +1303,96 @@ func (q *postgresQueries) GetPrimaryKeys(ctx context.Context) ([]getPrimaryKeysR
 	var items []getPrimaryKeysRow
 	for rows.Next() {
 		var i getPrimaryKeysRow
-		if err := rows.Scan(&i.TableName, &i.ColumnName); err != nil {
+		if err := rows.Scan(&i.TableName, &i.ColumnName, &i.ColumnType); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getPrimaryKeyColumns = `-- name: GetPrimaryKeyColumns :many
+select
+    t.relname::text as table_name,
+    ARRAY_AGG(a.attname::text ORDER BY array_position(i.indkey::int2[], a.attnum))::text[] as column_names
+from
+          pg_catalog.pg_class c
+     join pg_catalog.pg_namespace n on n.oid        = c.relnamespace
+     join pg_catalog.pg_index i     on i.indexrelid = c.oid AND i.indisprimary
+     join pg_catalog.pg_class t     on i.indrelid   = t.oid
+     JOIN   pg_catalog.pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+where
+        c.relkind in ('i', 'I')
+    and not t.relispartition
+    and n.nspname not in ('pg_catalog', 'pg_toast')
+    and pg_catalog.pg_table_is_visible(c.oid)
+GROUP BY t.relname
+`
+
+type getPrimaryKeyColumnsRow struct {
+	TableName   string   `json:"table_name"`
+	ColumnNames []string `json:"column_names"`
+}
+
+func (q *postgresQueries) GetPrimaryKeyColumns(ctx context.Context) ([]getPrimaryKeyColumnsRow, error) {
+	rows, err := q.db.Query(ctx, getPrimaryKeyColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []getPrimaryKeyColumnsRow
+	for rows.Next() {
+		var i getPrimaryKeyColumnsRow
+		if err := rows.Scan(&i.TableName, &i.ColumnNames); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getUniqueIndexes = `-- name: GetUniqueIndexes :many
+select
+    t.relname::text as table_name,
+    c.relname::text as index_name,
+    ARRAY_AGG(a.attname::text ORDER BY a.attnum)::text[] as column_names
+from
+          pg_catalog.pg_class c
+     join pg_catalog.pg_namespace n on n.oid        = c.relnamespace
+     join pg_catalog.pg_index i     on i.indexrelid = c.oid AND i.indisunique AND NOT i.indisprimary
+     join pg_catalog.pg_class t     on i.indrelid   = t.oid
+     JOIN   pg_catalog.pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+where
+        c.relkind in ('i', 'I')
+    and not t.relispartition
+    and n.nspname not in ('pg_catalog', 'pg_toast')
+    and pg_catalog.pg_table_is_visible(c.oid)
+GROUP BY t.relname, c.relname
+ORDER BY t.relname, c.relname
+`
+
+type getUniqueIndexesRow struct {
+	TableName   string   `json:"table_name"`
+	IndexName   string   `json:"index_name"`
+	ColumnNames []string `json:"column_names"`
+}
+
+func (q *postgresQueries) GetUniqueIndexes(ctx context.Context) ([]getUniqueIndexesRow, error) {
+	rows, err := q.db.Query(ctx, getUniqueIndexes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []getUniqueIndexesRow
+	for rows.Next() {
+		var i getUniqueIndexesRow
+		if err := rows.Scan(&i.TableName, &i.IndexName, &i.ColumnNames); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -0,0 +1,92 @@
+package datapasta
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// ChunkSize makes Insert upload `size` rows at a time, each chunk sent as its own batch (or COPY),
+// so that memory use and the size of each batch stay bounded for very large dumps.
+// Each chunk runs inside a savepoint, so the client must be given a transaction.
+// It can only be used with NewBatchClient.
+// Rows should come after the rows they reference, as Upload orders them.
+func ChunkSize(size int) ClientOpt {
+	return func(db *pgtx) {
+		db.chunkSize = size
+	}
+}
+
+// ChunkError is returned by Insert when a chunk fails to upload.
+// The chunk is rolled back, but earlier chunks stay inserted and mapped, so the upload can be resumed
+// in the same transaction by calling Insert again with the rows from Offset.
+type ChunkError struct {
+	// Offset is the index of the first row of the chunk that failed.
+	Offset int
+	Err    error
+}
+
+func (e ChunkError) Error() string {
+	return fmt.Sprintf("uploading rows from %d: %s", e.Offset, e.Err)
+}
+
+func (e ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// savepoint runs `f` inside a savepoint, rolling back to it if `f` fails.
+func (db pgbatchtx) savepoint(f func() error) error {
+	if _, err := db.tx.db.Exec(db.ctx, "SAVEPOINT datapasta_chunk"); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		if _, rollbackErr := db.tx.db.Exec(db.ctx, "ROLLBACK TO SAVEPOINT datapasta_chunk"); rollbackErr != nil {
+			return fmt.Errorf("%w (rolling back: %s)", err, rollbackErr)
+		}
+		return err
+	}
+	_, err := db.tx.db.Exec(db.ctx, "RELEASE SAVEPOINT datapasta_chunk")
+	return err
+}
+
+// rowKey identifies a row by its table and original primary key.
+func (db pgdb) rowKey(row map[string]any) string {
+	table := row[DumpTableKey].(string)
+	return table + "\x00" + textValue(row[db.pkGroups[table].ColumnName])
+}
+
+// patchTargets returns the keys of the rows that may be referenced by updates patching foreign keys after inserting:
+// rows of self-referencing tables, and of tables referenced by a foreign key that breaks a cycle.
+func (db pgdb) patchTargets(rows []map[string]any) map[string]bool {
+	tables := map[string]bool{}
+	for _, fk := range db.fks {
+		if _, ok := db.pkGroups[fk.BaseTable]; !ok {
+			continue
+		}
+		if _, ok := db.cycles[fk]; ok || fk.BaseTable == fk.ReferencingTable {
+			tables[fk.BaseTable] = true
+		}
+	}
+	keys := map[string]bool{}
+	for _, row := range rows {
+		if tables[row[DumpTableKey].(string)] {
+			keys[db.rowKey(row)] = true
+		}
+	}
+	return keys
+}
+
+// readyFollowups returns a batch of the pending followups and `followups` whose referenced rows have been inserted,
+// and the followups that must wait for a later chunk to insert theirs.
+func (db pgbatchtx) readyFollowups(followups []followupQuery, later map[string]bool) (*pgx.Batch, []followupQuery) {
+	ready := &pgx.Batch{}
+	pending := []followupQuery{}
+	for _, f := range append(*db.pending, followups...) {
+		if later[f.target] {
+			pending = append(pending, f)
+		} else {
+			ready.Queue(f.sql, f.args...)
+		}
+	}
+	return ready, pending
+}
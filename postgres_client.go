@@ -0,0 +1,281 @@
+package datapasta
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgx/v4"
+)
+
+// NewClient creates a client that can be used as a Database for Upload and Download.
+// it is recommended you pass an open transaction, so you can control committing or rolling it back.
+// Unlike the batching client, it inserts one row at a time and keeps the mapping in memory instead of in a temporary table,
+// so it works where temporary tables can't be used, such as behind PgBouncer in transaction mode.
+// Insert updates the primary key of every uploaded row in place.
+func (db pgdb) NewClient(ctx context.Context, tx Postgreser, opts ...ClientOpt) (pgtx, error) {
+	child := pgtx{
+		pgdb:    db,
+		tx:      postgresQueries{tx},
+		ctx:     ctx,
+		found:   NewMemoryKeySet(),
+		mapping: &memoryMapping{cloneOf: map[string]any{}},
+	}
+	for _, o := range opts {
+		o(&child)
+	}
+	if child.bulkCopy {
+		return pgtx{}, fmt.Errorf("BulkCopy can only be used with NewBatchClient")
+	}
+	if child.chunkSize > 0 {
+		return pgtx{}, fmt.Errorf("ChunkSize can only be used with NewBatchClient")
+	}
+	return child, nil
+}
+
+// memoryMapping is the mapping created by the inserts of a pgtx.
+type memoryMapping struct {
+	mapping []Mapping
+	// cloneOf has the new primary key of every mapped row, by table and original primary key
+	cloneOf map[string]any
+}
+
+func (m *memoryMapping) add(table string, original, clone any) {
+	m.mapping = append(m.mapping, Mapping{RecordID: RecordID{Table: table, PrimaryKey: clone}, OriginalID: original})
+	m.cloneOf[table+"\x00"+textValue(original)] = clone
+}
+
+func (db pgtx) Mapping() ([]Mapping, error) {
+	if db.mapping == nil {
+		return nil, fmt.Errorf("the client wasn't created by NewClient")
+	}
+	return append([]Mapping{}, db.mapping.mapping...), nil
+}
+
+func (db pgtx) Insert(rows ...map[string]any) error {
+	if db.mapping == nil {
+		return fmt.Errorf("the client wasn't created by NewClient")
+	}
+	return db.withoutTriggers(func() error { return db.insertEach(rows) })
+}
+
+// rowPatch is an update of a reference to a row that hadn't been inserted yet.
+type rowPatch struct {
+	table, pk, col string
+	id             any
+	// target is the table and original primary key of the referenced row, and value is the original reference
+	target string
+	value  any
+	// guard is the condition on the current value of the column, for rows that may have matched an existing row
+	guard squirrel.Sqlizer
+}
+
+// insertEach inserts the rows one at a time, in order, and then patches the references to rows that came later.
+func (db pgtx) insertEach(rows []map[string]any) error {
+	start := time.Now()
+	progress := db.newProgress(len(rows))
+
+	// later has the rows that haven't been inserted yet, and resolved has every row that references can be mapped onto
+	later := map[string]bool{}
+	resolved := map[string]bool{}
+	for _, row := range rows {
+		if _, ok := db.pkGroups[row[DumpTableKey].(string)]; ok {
+			later[db.rowKey(row)] = true
+			resolved[db.rowKey(row)] = true
+		}
+	}
+	for key := range db.mapping.cloneOf {
+		resolved[key] = true
+	}
+
+	// fail before inserting anything if references can't be resolved
+	if err := db.checkReferences(rows, resolved); err != nil {
+		return err
+	}
+
+	patches := []rowPatch{}
+	deferConstraints := map[string]bool{}
+	created := make([]Mapping, 0, len(rows))
+
+	for _, row := range rows {
+		table := row[DumpTableKey].(string)
+		if err := db.rewriteUniques(row); err != nil {
+			return err
+		}
+
+		pk := ""
+		if pkg, found := db.pkGroups[table]; found {
+			pk = pkg.ColumnName
+		}
+		oldPK := row[pk]
+		match, matching := db.matches[table]
+		skipping := matching && match.action == MatchSkip
+
+		values := map[string]any{DumpTableKey: table}
+		rowPatches := []rowPatch{}
+		rowConstraints := map[string]bool{}
+		for k, v := range row {
+			if v == nil || k == DumpTableKey {
+				continue
+			}
+
+			deferred := false
+			fk, v, foundForeign, mapped := db.foreignValue(row, k, v, resolved, &UnresolvedReferencesError{})
+			if mapped {
+				target := fk.BaseTable + "\x00" + textValue(v)
+				if clone, ok := db.mapping.cloneOf[target]; ok {
+					v = clone
+				} else if later[target] {
+					// the referenced row comes later, so the column is patched once it exists.
+					// otherwise the row isn't part of the dump, so the reference is kept as it is
+					keep, guard, err := db.patchedReference(table, pk, k, fk, v, skipping, rowConstraints)
+					if err != nil {
+						return err
+					}
+					deferred = !keep
+					rowPatches = append(rowPatches, rowPatch{table: table, pk: pk, col: k, target: target, value: v, guard: guard})
+				}
+			}
+			if deferred || (!foundForeign && k == pk && !db.preserveIDs && !(matching && match.includes(k))) {
+				continue
+			}
+
+			if write, _ := db.writable(table, k, pk); write {
+				values[k] = v
+			}
+		}
+
+		// constraints are deferred as rows first need them
+		newConstraints := map[string]bool{}
+		for c := range rowConstraints {
+			if !deferConstraints[c] {
+				newConstraints[c] = true
+				deferConstraints[c] = true
+			}
+		}
+		if err := db.deferConstraints(newConstraints); err != nil {
+			return err
+		}
+
+		id, err := db.insertRow(table, pk, values)
+		if err != nil {
+			return fmt.Errorf("inserting %s(%v): %w", table, oldPK, err)
+		}
+		if pk != "" {
+			db.mapping.add(table, oldPK, id)
+			created = append(created, Mapping{RecordID: RecordID{Table: table, PrimaryKey: id}, OriginalID: oldPK})
+			delete(later, table+"\x00"+textValue(oldPK))
+			row[pk] = id
+		}
+		for _, p := range rowPatches {
+			p.id = id
+			patches = append(patches, p)
+		}
+		progress.queued()
+		progress.executed(table, 1)
+	}
+
+	progress.FollowupsQueued = len(patches)
+	for _, p := range patches {
+		v := p.value
+		if clone, ok := db.mapping.cloneOf[p.target]; ok {
+			v = clone
+		}
+		where := squirrel.And{squirrel.Eq{`"` + p.pk + `"`: p.id}}
+		if p.guard != nil {
+			where = append(where, p.guard)
+		}
+		sql, args, err := db.builder.Update(`"`+p.table+`"`).Set(`"`+p.col+`"`, v).Where(where).ToSql()
+		if err != nil {
+			return err
+		}
+		if _, err := db.tx.db.Exec(db.ctx, sql, args...); err != nil {
+			return fmt.Errorf("patching %s.%s: %w", p.table, p.col, err)
+		}
+		progress.followedUp()
+	}
+
+	LogFunc("inserted rows:%d, patched:%d in %s", len(rows), len(patches), time.Since(start))
+
+	if db.preserveIDs {
+		if err := db.advanceSequences(rows); err != nil {
+			return err
+		}
+	}
+	if err := db.saveMapping(created); err != nil {
+		return err
+	}
+	progress.done()
+	return nil
+}
+
+// insertRow inserts the values of a single row with InsertRecord's statement, returning its primary key.
+// Rows that match an existing row through MatchExisting return the existing row's primary key instead.
+func (db pgtx) insertRow(table, pk string, values map[string]any) (any, error) {
+	match, matching := db.matches[table]
+	sql, args, err := db.insertStatement(values, func(keys []string) string {
+		suffix := []string{}
+		if matching {
+			suffix = append(suffix, match.onConflict(keys, pk))
+		}
+		if pk != "" {
+			suffix = append(suffix, `RETURNING "`+pk+`"`)
+		}
+		return strings.Join(suffix, " ")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if pk == "" {
+		cmd, err := db.tx.db.Exec(db.ctx, sql, args...)
+		if err == nil && matching && match.action == MatchFail && cmd.RowsAffected() == 0 {
+			err = fmt.Errorf("it matches an existing row")
+		}
+		return nil, err
+	}
+
+	var id any
+	err = db.tx.db.QueryRow(db.ctx, sql, args...).Scan(&id)
+	if err == pgx.ErrNoRows && matching && match.action == MatchSkip {
+		existing := squirrel.Eq{}
+		for _, col := range match.columns {
+			existing[`"`+col+`"`] = values[col]
+		}
+		sql, args, err := db.builder.Select(`"` + pk + `"`).From(`"` + table + `"`).Where(existing).ToSql()
+		if err != nil {
+			return nil, err
+		}
+		err = db.tx.db.QueryRow(db.ctx, sql, args...).Scan(&id)
+		return nativeValue(id), err
+	} else if err == pgx.ErrNoRows && matching {
+		return nil, fmt.Errorf("it matches an existing row")
+	}
+	return nativeValue(id), err
+}
+
+// saveMapping adds mappings to "datapasta_mapping", if PersistMapping was used.
+func (db pgtx) saveMapping(created []Mapping) error {
+	if db.session == "" || len(created) == 0 {
+		return nil
+	}
+	if _, err := db.tx.db.Exec(db.ctx, createSessionMapping); err != nil {
+		return err
+	}
+	batch := &pgx.Batch{}
+	for _, m := range created {
+		batch.Queue(`INSERT INTO datapasta_mapping (session_id, table_name, original_id, clone_id) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (session_id, table_name, original_id) DO UPDATE SET clone_id = EXCLUDED.clone_id`,
+			db.session, m.Table, textValue(m.OriginalID), textValue(m.PrimaryKey))
+	}
+	res := db.tx.db.SendBatch(db.ctx, batch)
+	for range created {
+		if _, err := res.Exec(); err != nil {
+			res.Close()
+			return fmt.Errorf("persisting mapping: %w", err)
+		}
+	}
+	return res.Close()
+}
@@ -0,0 +1,365 @@
+package datapasta
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+)
+
+// BulkCopy makes Insert load each table with COPY instead of sending one INSERT per row.
+// New primary keys are reserved up front from each table's sequence (or column default), and primary and
+// foreign keys are rewritten before copying. The mapping is recorded in "datapasta_clone" as usual.
+// Unlike the batched inserts, nil values are copied as NULL rather than being left to column defaults.
+func BulkCopy() ClientOpt {
+	return func(db *pgtx) {
+		db.bulkCopy = true
+	}
+}
+
+// copyInsert copies `rows` table by table. References to rows in `later`, which a later chunk copies,
+// are patched once those rows are copied.
+func (db pgbatchtx) copyInsert(rows []map[string]any, resolved, later map[string]bool, progress *uploadProgress) error {
+	if len(db.matches) > 0 {
+		return fmt.Errorf("MatchExisting can't be used with BulkCopy")
+	}
+
+	start := time.Now()
+
+	// group the rows by table, and copy referenced tables first
+	byTable := map[string][]map[string]any{}
+	tables := []string{}
+	for _, row := range rows {
+		table := row[DumpTableKey].(string)
+		if err := db.rewriteUniques(row); err != nil {
+			return err
+		}
+		if _, ok := byTable[table]; !ok {
+			tables = append(tables, table)
+		}
+		byTable[table] = append(byTable[table], row)
+	}
+	tables, err := sortTables(db.withoutCycles(), tables)
+	if err != nil {
+		return err
+	}
+
+	// start from the rows that earlier inserts mapped and these rows reference
+	mapping, err := db.clonesOf(rows)
+	if err != nil {
+		return err
+	}
+
+	// reserve new primary keys for every table
+	created := [][]any{}
+	for _, table := range tables {
+		pk, ok := db.pkGroups[table]
+		if !ok {
+			continue
+		}
+		ids := make([]any, 0, len(byTable[table]))
+		if db.preserveIDs {
+			for _, row := range byTable[table] {
+				ids = append(ids, row[pk.ColumnName])
+			}
+		} else if ids, err = db.reserveIDs(table, pk.ColumnName, len(byTable[table])); err != nil {
+			return fmt.Errorf("reserving ids for %s: %w", table, err)
+		}
+		for i, row := range byTable[table] {
+			if row[pk.ColumnName] == nil {
+				continue
+			}
+			mapping[table+"\x00"+textValue(row[pk.ColumnName])] = ids[i]
+			created = append(created, []any{table, textValue(row[pk.ColumnName]), textValue(ids[i])})
+		}
+	}
+
+	prepped := time.Now()
+
+	ci, err := db.connInfo()
+	if err != nil {
+		return err
+	}
+	copied := 0
+	unresolved := UnresolvedReferencesError{}
+	// references that close a cycle between tables are patched after copying, or checked at commit if NOT NULL
+	patches := &pgx.Batch{}
+	followups := []followupQuery{}
+	deferConstraints := map[string]bool{}
+	tableValues := make(map[string][][]any, len(tables))
+	tableCols := make(map[string][]string, len(tables))
+	for _, table := range tables {
+		types, err := db.columnTypes(table)
+		if err != nil {
+			return err
+		}
+
+		pk := ""
+		if pkg, ok := db.pkGroups[table]; ok {
+			pk = pkg.ColumnName
+		}
+
+		// COPY always writes identity columns, so only generated columns and generated identities are left out
+		colSet := map[string]bool{}
+		for _, row := range byTable[table] {
+			for k := range row {
+				if write, _ := db.writable(table, k, pk); write && k != DumpTableKey {
+					colSet[k] = true
+				}
+			}
+		}
+		cols := make([]string, 0, len(colSet))
+		for k := range colSet {
+			cols = append(cols, k)
+		}
+		sort.Strings(cols)
+		refs := map[string]ForeignKey{}
+		for _, fk := range db.fks {
+			if fk.ReferencingTable == table {
+				refs[fk.ReferencingCol] = fk
+			}
+		}
+
+		values := make([][]any, 0, len(byTable[table]))
+		for _, row := range byTable[table] {
+			vals := make([]any, 0, len(cols))
+			for _, col := range cols {
+				v := row[col]
+				if v != nil {
+					if col == pk {
+						v = mapping[table+"\x00"+textValue(v)]
+					} else if fk, ok := refs[col]; ok {
+						target := fk.BaseTable + "\x00" + textValue(v)
+						cycle, inCycle := db.cycles[fk]
+						if mapped, ok := mapping[target]; ok {
+							v = mapped
+						} else if later[target] && pk != "" {
+							// the referenced row is copied by a later chunk, which maps it before the reference is patched
+							var findInMap any = squirrel.Expr("COALESCE(?, ?)", db.cloneOf(fk.BaseTable, v), v)
+							if db.preserveIDs {
+								findInMap = v
+							}
+							sql, args, err := db.builder.Update(`"`+table+`"`).Set(`"`+col+`"`, findInMap).
+								Where(squirrel.Eq{`"` + pk + `"`: mapping[table+"\x00"+textValue(row[pk])]}).ToSql()
+							if err != nil {
+								return fmt.Errorf(`build: %w, args: %s, sql: %s`, err, args, sql)
+							}
+							followups = append(followups, followupQuery{target: target, sql: sql, args: args})
+							keep, _, err := db.patchedReference(table, pk, col, fk, v, false, deferConstraints)
+							if err != nil {
+								return err
+							}
+							if !keep {
+								v = nil
+							}
+							inCycle = false
+						} else if _, ok := db.pkGroups[fk.BaseTable]; ok && !resolved[target] {
+							v, _ = db.resolveReference(fk, row, v, &unresolved)
+						}
+						if inCycle && v != nil {
+							switch {
+							case cycle.Nullable && pk != "":
+								patches.Queue(`UPDATE "`+table+`" SET "`+col+`" = $1 WHERE "`+pk+`" = $2`, v, mapping[table+"\x00"+textValue(row[pk])])
+								v = nil
+							default:
+								if err := deferCycle(table, col, cycle, deferConstraints); err != nil {
+									return err
+								}
+							}
+						}
+					}
+				}
+				v, err := copyValue(ci, types[col], v)
+				if err != nil {
+					return fmt.Errorf("copying %s.%s: %w", table, col, err)
+				}
+				vals = append(vals, v)
+			}
+			values = append(values, vals)
+			progress.queued()
+		}
+		tableValues[table], tableCols[table] = values, cols
+	}
+
+	if len(unresolved.References) > 0 {
+		return unresolved
+	}
+
+	if err := db.deferConstraints(deferConstraints); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		n, err := db.tx.db.CopyFrom(db.ctx, pgx.Identifier{table}, tableCols[table], pgx.CopyFromRows(tableValues[table]))
+		if err != nil {
+			return fmt.Errorf("copying %s: %w", table, err)
+		}
+		copied += int(n)
+		progress.executed(table, int(n))
+	}
+
+	res := db.tx.db.SendBatch(db.ctx, patches)
+	for i := 0; i < patches.Len(); i++ {
+		if _, err := res.Exec(); err != nil {
+			res.Close()
+			return fmt.Errorf("patching cyclic reference %d: %w", i, err)
+		}
+	}
+	if err := res.Close(); err != nil {
+		return err
+	}
+
+	if _, err := db.tx.db.CopyFrom(db.ctx, pgx.Identifier{"datapasta_clone"}, []string{"table_name", "original_id", "clone_id"}, pgx.CopyFromRows(created)); err != nil {
+		return fmt.Errorf("copying mapping: %w", err)
+	}
+
+	// references to rows of later chunks are patched once the chunk that copies them is mapped
+	followup, pending := db.readyFollowups(followups, later)
+	progress.FollowupsQueued += followup.Len()
+	res = db.tx.db.SendBatch(db.ctx, followup)
+	for i := 0; i < followup.Len(); i++ {
+		if _, err := res.Exec(); err != nil {
+			res.Close()
+			return fmt.Errorf("patching reference %d: %w", i, err)
+		}
+		progress.followedUp()
+	}
+	if err := res.Close(); err != nil {
+		return err
+	}
+	*db.pending = pending
+
+	LogFunc("copied rows:%d, tables:%d", copied, len(tables))
+	LogFunc("prepping: %s, copying: %s", prepped.Sub(start), time.Since(prepped))
+	return nil
+}
+
+// reserveIDs generates `n` new primary keys for a table, from its sequence or from the column's default.
+func (db pgbatchtx) reserveIDs(table, col string, n int) ([]any, error) {
+	var seq *string
+	if err := db.tx.db.QueryRow(db.ctx, "SELECT pg_get_serial_sequence($1, $2)", `"`+table+`"`, col).Scan(&seq); err != nil {
+		return nil, err
+	}
+
+	sql, args := "SELECT nextval($1::regclass) FROM generate_series(1, $2)", []any{seq, n}
+	if seq == nil {
+		var def *string
+		err := db.tx.db.QueryRow(db.ctx, `SELECT pg_get_expr(d.adbin, d.adrelid) FROM pg_catalog.pg_attrdef d
+			JOIN pg_catalog.pg_attribute a ON a.attrelid = d.adrelid AND a.attnum = d.adnum
+			WHERE d.adrelid = $1::regclass AND a.attname = $2`, `"`+table+`"`, col).Scan(&def)
+		if err == pgx.ErrNoRows || def == nil {
+			return nil, fmt.Errorf("column %s has no sequence or default to generate new values", col)
+		} else if err != nil {
+			return nil, err
+		}
+		sql, args = "SELECT "+*def+" FROM generate_series(1, $1)", []any{n}
+	}
+
+	rows, err := db.tx.db.Query(db.ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]any, 0, n)
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, nativeValue(vals[0]))
+	}
+	return ids, rows.Err()
+}
+
+// columnTypes returns the type oid of every column of a table.
+func (db pgbatchtx) columnTypes(table string) (map[string]uint32, error) {
+	rows, err := db.tx.db.Query(db.ctx, `SELECT * FROM "`+table+`" LIMIT 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types := map[string]uint32{}
+	for _, f := range rows.FieldDescriptions() {
+		types[string(f.Name)] = f.DataTypeOID
+	}
+	return types, rows.Err()
+}
+
+// copyValue prepares a value for the binary COPY protocol.
+// Values that were downloaded as text (such as numerics, arrays or intervals) are parsed into the column's type,
+// as COPY would otherwise send the text as if it were the binary encoding.
+func copyValue(ci *pgtype.ConnInfo, oid uint32, v any) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	dt, ok := ci.DataTypeForOID(oid)
+	if !ok {
+		return v, nil
+	}
+	if _, ok := dt.Value.(*pgtype.Text); ok {
+		return v, nil
+	}
+	val := pgtype.NewValue(dt.Value)
+	decoder, ok := val.(pgtype.TextDecoder)
+	if !ok {
+		return v, nil
+	}
+	if err := decoder.DecodeText(ci, []byte(s)); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// sortTables orders tables so that tables come after the tables they reference.
+// Tables that don't depend on each other keep their order.
+func sortTables(fks []ForeignKey, tables []string) ([]string, error) {
+	included := map[string]bool{}
+	for _, t := range tables {
+		included[t] = true
+	}
+	dependsOn := map[string]map[string]bool{}
+	for _, fk := range fks {
+		if fk.BaseTable == fk.ReferencingTable || !included[fk.BaseTable] || !included[fk.ReferencingTable] {
+			continue
+		}
+		if dependsOn[fk.ReferencingTable] == nil {
+			dependsOn[fk.ReferencingTable] = map[string]bool{}
+		}
+		dependsOn[fk.ReferencingTable][fk.BaseTable] = true
+	}
+
+	out := make([]string, 0, len(tables))
+	done := map[string]bool{}
+	for len(out) < len(tables) {
+		progressed := false
+		for _, t := range tables {
+			if done[t] {
+				continue
+			}
+			ready := true
+			for dep := range dependsOn[t] {
+				ready = ready && done[dep]
+			}
+			if ready {
+				done[t] = true
+				out = append(out, t)
+				progressed = true
+			}
+		}
+		if !progressed {
+			cyclic := []string{}
+			for _, t := range tables {
+				if !done[t] {
+					cyclic = append(cyclic, t)
+				}
+			}
+			return nil, fmt.Errorf("tables %s reference each other, so they can't be copied in order", strings.Join(cyclic, ", "))
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,102 @@
+package datapasta
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgtype"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortTables(t *testing.T) {
+	ok := assert.New(t)
+	fks := []ForeignKey{
+		{BaseTable: "company", BaseCol: "id", ReferencingTable: "product", ReferencingCol: "company_id"},
+		{BaseTable: "factory", BaseCol: "id", ReferencingTable: "product", ReferencingCol: "factory_id"},
+		{BaseTable: "product", BaseCol: "id", ReferencingTable: "product", ReferencingCol: "variant_of"},
+	}
+
+	tables, err := sortTables(fks, []string{"product", "company", "factory"})
+	ok.NoError(err)
+	ok.Equal([]string{"company", "factory", "product"}, tables)
+
+	fks = append(fks, ForeignKey{BaseTable: "product", BaseCol: "id", ReferencingTable: "company", ReferencingCol: "best_seller_id"})
+	_, err = sortTables(fks, []string{"product", "company", "factory"})
+	ok.EqualError(err, "tables product, company reference each other, so they can't be copied in order")
+}
+
+func TestCopyValue(t *testing.T) {
+	ok := assert.New(t)
+	ci := pgtype.NewConnInfo()
+
+	// text stays as-is
+	v, err := copyValue(ci, pgtype.TextOID, "12.50")
+	ok.NoError(err)
+	ok.Equal("12.50", v)
+
+	// other types are parsed from their text form
+	v, err = copyValue(ci, pgtype.NumericOID, "12.50")
+	ok.NoError(err)
+	ok.IsType(&pgtype.Numeric{}, v)
+
+	v, err = copyValue(ci, pgtype.Int4ArrayOID, "{1,2}")
+	ok.NoError(err)
+	ok.IsType(&pgtype.Int4Array{}, v)
+
+	_, err = copyValue(ci, pgtype.Int4ArrayOID, "not an array")
+	ok.Error(err)
+
+	// values that aren't strings don't need converting
+	v, err = copyValue(ci, pgtype.Int4OID, int32(4))
+	ok.NoError(err)
+	ok.Equal(int32(4), v)
+}
+
+func TestChunkedCopy(t *testing.T) {
+	ok := assert.New(t)
+	seq := "person_id_seq"
+	next := int64(100)
+	lookups := [][]any{}
+	conn := &recordingConn{row: []any{&seq}, query: func(sql string, args []any) *recordedRows {
+		switch {
+		case strings.Contains(sql, "datapasta_clone"):
+			lookups = append(lookups, args)
+		case strings.Contains(sql, "nextval"):
+			next++
+			return &recordedRows{values: [][]any{{next}}}
+		case strings.Contains(sql, "LIMIT 0"):
+			return &recordedRows{fields: []string{"id", "manager_id"}}
+		}
+		return &recordedRows{}
+	}}
+	db, err := pgdb{
+		pkGroups: map[string]getPrimaryKeysRow{"person": {TableName: "person", ColumnName: "id", ColumnType: "integer"}},
+		fks:      []ForeignKey{{BaseTable: "person", BaseCol: "id", ReferencingTable: "person", ReferencingCol: "manager_id"}},
+		builder:  squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+	}.NewBatchClient(context.Background(), conn, BulkCopy(), ChunkSize(1))
+	ok.NoError(err)
+
+	// a reference to a row of a later chunk is copied as NULL, and patched once that chunk is copied
+	ok.NoError(db.Insert(
+		map[string]any{DumpTableKey: "person", "id": 1, "manager_id": 2},
+		map[string]any{DumpTableKey: "person", "id": 2, "manager_id": nil},
+	))
+	copies := []string{}
+	for _, e := range conn.execs {
+		if strings.HasPrefix(e, "copy ") || strings.HasPrefix(e, "batch ") {
+			copies = append(copies, e)
+		}
+	}
+	ok.Equal([]string{
+		"copy [person] [id manager_id] [[101 <nil>]]", "batch of 0",
+		"copy [datapasta_clone] [table_name original_id clone_id] [[person 1 101]]", "batch of 0",
+		"copy [person] [id manager_id] [[102 <nil>]]", "batch of 0",
+		"copy [datapasta_clone] [table_name original_id clone_id] [[person 2 102]]", "batch of 1",
+	}, copies)
+	ok.Empty(*db.pending)
+
+	// and only the mapping of the rows that each chunk references is loaded
+	ok.Equal([][]any{{"person", []string{"2"}}}, lookups)
+}
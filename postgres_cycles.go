@@ -0,0 +1,140 @@
+package datapasta
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+)
+
+// breakCycles picks the foreign keys to patch after inserting, so that tables referencing each other in a cycle
+// can still be inserted in order. Nullable columns are picked over NOT NULL ones wherever possible.
+// Self-referencing foreign keys are always patched, so they aren't included.
+func breakCycles(fks []ForeignKey, options []getForeignKeyOptionsRow) map[ForeignKey]getForeignKeyOptionsRow {
+	byColumn := make(map[string]getForeignKeyOptionsRow, len(options))
+	for _, o := range options {
+		byColumn[o.ReferencingTable+"."+o.ReferencingCol] = o
+	}
+	optionsOf := func(fk ForeignKey) getForeignKeyOptionsRow {
+		return byColumn[fk.ReferencingTable+"."+fk.ReferencingCol]
+	}
+
+	// keep NOT NULL references first, so that cycles are broken by nullable ones
+	edges := make([]ForeignKey, 0, len(fks))
+	for _, fk := range fks {
+		if fk.BaseTable != fk.ReferencingTable {
+			edges = append(edges, fk)
+		}
+	}
+	sort.SliceStable(edges, func(i, j int) bool {
+		return !optionsOf(edges[i]).Nullable && optionsOf(edges[j]).Nullable
+	})
+
+	kept := map[string][]string{}
+	reaches := func(from, to string) bool {
+		seen := map[string]bool{from: true}
+		stack := []string{from}
+		for len(stack) > 0 {
+			t := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if t == to {
+				return true
+			}
+			for _, next := range kept[t] {
+				if !seen[next] {
+					seen[next] = true
+					stack = append(stack, next)
+				}
+			}
+		}
+		return false
+	}
+
+	cycles := map[ForeignKey]getForeignKeyOptionsRow{}
+	for _, fk := range edges {
+		if reaches(fk.BaseTable, fk.ReferencingTable) {
+			cycles[fk] = optionsOf(fk)
+			continue
+		}
+		kept[fk.ReferencingTable] = append(kept[fk.ReferencingTable], fk.BaseTable)
+	}
+	return cycles
+}
+
+// DeferredForeignKeys returns the foreign keys that are patched after inserting to break cycles between tables,
+// so Upload doesn't need to order the dump by them.
+func (db pgdb) DeferredForeignKeys() []ForeignKey {
+	out := make([]ForeignKey, 0, len(db.cycles))
+	for fk := range db.cycles {
+		out = append(out, fk)
+	}
+	return out
+}
+
+// withoutCycles returns the foreign keys that aren't patched after inserting.
+func (db pgdb) withoutCycles() []ForeignKey {
+	out := make([]ForeignKey, 0, len(db.fks))
+	for _, fk := range db.fks {
+		if _, ok := db.cycles[fk]; !ok {
+			out = append(out, fk)
+		}
+	}
+	return out
+}
+
+// patchedReference checks that the reference from `table`.`col` through `fk` can be patched after the row is inserted,
+// and returns whether the column keeps its original value until then, instead of being inserted as NULL.
+// NOT NULL columns that break a cycle keep it, and their constraint is added to `deferred` to be checked at commit.
+// For rows that may match an existing row and keep it as it is, `guard` is the condition for patching the column.
+func (db pgdb) patchedReference(table, pk, col string, fk ForeignKey, v any, skipping bool, deferred map[string]bool) (keep bool, guard squirrel.Sqlizer, err error) {
+	cycle, inCycle := db.cycles[fk]
+	switch {
+	case pk == "" && inCycle:
+		return false, nil, fmt.Errorf("can't break the foreign key cycle through %s.%s without a primary key", table, col)
+	case pk == "" && fk.BaseTable == table:
+		return false, nil, fmt.Errorf("can't have self-referencing tables without primary key")
+	case pk == "":
+		return false, nil, fmt.Errorf("can't patch %s.%s, which references a later row, without a primary key", table, col)
+	}
+
+	keep = inCycle && !cycle.Nullable
+	if keep {
+		if err := deferCycle(table, col, cycle, deferred); err != nil {
+			return false, nil, err
+		}
+	}
+	if skipping {
+		// rows that matched an existing row are only patched where the column is still unset
+		if keep {
+			guard = squirrel.Eq{`"` + col + `"`: v}
+		} else {
+			guard = squirrel.Expr(`"` + col + `" IS NULL`)
+		}
+	}
+	return keep, guard, nil
+}
+
+// deferCycle adds the constraint of a NOT NULL column that breaks a cycle to `deferred`, so that it's checked at commit,
+// after the column is patched.
+func deferCycle(table, col string, cycle getForeignKeyOptionsRow, deferred map[string]bool) error {
+	if !cycle.Deferrable {
+		return fmt.Errorf("can't break the foreign key cycle through %s.%s, as it is NOT NULL and %s is not DEFERRABLE", table, col, cycle.ConstraintName)
+	}
+	deferred[cycle.ConstraintName] = true
+	return nil
+}
+
+// deferConstraints makes the constraints only be checked at commit.
+func (db pgtx) deferConstraints(constraints map[string]bool) error {
+	if len(constraints) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(constraints))
+	for c := range constraints {
+		names = append(names, `"`+c+`"`)
+	}
+	sort.Strings(names)
+	_, err := db.tx.db.Exec(db.ctx, "SET CONSTRAINTS "+strings.Join(names, ", ")+" DEFERRED")
+	return err
+}
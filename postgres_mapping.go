@@ -0,0 +1,143 @@
+package datapasta
+
+import (
+	"context"
+	"fmt"
+)
+
+// PersistMapping makes Insert also save the mapping in the "datapasta_mapping" table under `sessionID`.
+// Unlike "datapasta_clone", that table outlives the transaction, so the mapping can be loaded later
+// with LoadMapping, for example to merge a sandbox back with ReverseForeignKeyMapping and ApplyMergeStrategy.
+func PersistMapping(sessionID string) ClientOpt {
+	return func(db *pgtx) {
+		db.session = sessionID
+	}
+}
+
+const createSessionMapping = `CREATE TABLE IF NOT EXISTS datapasta_mapping(
+	session_id text, table_name text, original_id text, clone_id text,
+	PRIMARY KEY (session_id, table_name, original_id)
+)`
+
+// persistMapping copies the temporary mapping of `rows` into "datapasta_mapping", if PersistMapping was used.
+// Rows mapped by earlier inserts have already been copied, so they're left alone.
+func (db pgbatchtx) persistMapping(rows []map[string]any) error {
+	if db.session == "" {
+		return nil
+	}
+	tables := make([]string, 0, len(rows))
+	ids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		table := row[DumpTableKey].(string)
+		if pk, ok := db.pkGroups[table]; ok && row[pk.ColumnName] != nil {
+			tables = append(tables, table)
+			ids = append(ids, textValue(row[pk.ColumnName]))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := db.tx.db.Exec(db.ctx, createSessionMapping); err != nil {
+		return err
+	}
+	_, err := db.tx.db.Exec(db.ctx, `INSERT INTO datapasta_mapping (session_id, table_name, original_id, clone_id)
+		SELECT $1, c.table_name, c.original_id, c.clone_id FROM datapasta_clone c
+			JOIN unnest($2::text[], $3::text[]) AS r(table_name, original_id) USING (table_name, original_id)
+		ON CONFLICT (session_id, table_name, original_id) DO UPDATE SET clone_id = EXCLUDED.clone_id`, db.session, tables, ids)
+	if err != nil {
+		return fmt.Errorf("persisting mapping: %w", err)
+	}
+	return nil
+}
+
+// LoadMapping returns the mapping saved under `sessionID` by a client created with PersistMapping.
+func (db pgdb) LoadMapping(ctx context.Context, conn Postgreser, sessionID string) ([]Mapping, error) {
+	q := postgresQueries{db: conn}
+	if exists, err := q.HasSessionMapping(ctx); err != nil || !exists {
+		return nil, err
+	}
+	tables, err := q.GetSessionTables(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	mapps := make([]Mapping, 0)
+	for _, table := range tables {
+		pk, ok := db.pkGroups[table]
+		if !ok {
+			return nil, fmt.Errorf("no primary key for mapped table %s", table)
+		}
+		rows, err := q.GetSessionMapping(ctx, sessionID, table, pk.ColumnType)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			mapps = append(mapps, Mapping{RecordID: RecordID{Table: table, PrimaryKey: r.CloneID}, OriginalID: r.OriginalID})
+		}
+	}
+	return mapps, nil
+}
+
+// DeleteMapping removes the mapping saved under `sessionID`, once it is no longer needed.
+func (db pgdb) DeleteMapping(ctx context.Context, conn Postgreser, sessionID string) error {
+	q := postgresQueries{db: conn}
+	if exists, err := q.HasSessionMapping(ctx); err != nil || !exists {
+		return err
+	}
+	_, err := conn.Exec(ctx, "DELETE FROM datapasta_mapping WHERE session_id = $1", sessionID)
+	return err
+}
+
+func (q *postgresQueries) HasSessionMapping(ctx context.Context) (bool, error) {
+	var exists bool
+	err := q.db.QueryRow(ctx, "SELECT to_regclass('datapasta_mapping') IS NOT NULL").Scan(&exists)
+	return exists, err
+}
+
+const getSessionTables = `
+	SELECT DISTINCT table_name FROM datapasta_mapping WHERE session_id = $1 ORDER BY table_name
+`
+
+func (q *postgresQueries) GetSessionTables(ctx context.Context, sessionID string) ([]string, error) {
+	rows, err := q.db.Query(ctx, getSessionTables, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var i string
+		if err := rows.Scan(&i); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// getSessionMapping is formatted with the type of the table's primary key
+const getSessionMapping = `
+	SELECT original_id::%[1]s, clone_id::%[1]s FROM datapasta_mapping WHERE session_id = $1 AND table_name = $2
+`
+
+func (q *postgresQueries) GetSessionMapping(ctx context.Context, sessionID, table, columnType string) ([]getMappingRow, error) {
+	rows, err := q.db.Query(ctx, fmt.Sprintf(getSessionMapping, columnType), sessionID, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []getMappingRow
+	for rows.Next() {
+		vals, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, getMappingRow{OriginalID: nativeValue(vals[0]), CloneID: nativeValue(vals[1])})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
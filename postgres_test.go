@@ -0,0 +1,760 @@
+package datapasta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMappingValues(t *testing.T) {
+	ok := assert.New(t)
+
+	raw := [16]byte{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	id := nativeValue(raw)
+	ok.Equal(pgtype.UUID{Bytes: raw, Status: pgtype.Present}, id)
+
+	// keys are compared as postgres would cast them to text
+	ok.Equal("6ba7b810-9dad-11d1-80b4-00c04fd430c8", textValue(id))
+	ok.Equal("42", textValue(int32(42)))
+	ok.Equal("42", textValue(float64(42)))
+	ok.Equal("1000000", textValue(float64(1e6)))
+	ok.Equal("1.5", textValue(1.5))
+	ok.Equal("abc", textValue("abc"))
+}
+
+func TestMatchExistingOnConflict(t *testing.T) {
+	ok := assert.New(t)
+	keys := []string{`"id"`, `"company_id"`, `"email"`, `"name"`}
+
+	skip := matchExisting{columns: []string{"company_id", "email"}, action: MatchSkip}
+	ok.Equal(`ON CONFLICT ("company_id", "email") DO NOTHING`, skip.onConflict(keys, "id"))
+	ok.True(skip.includes("email"))
+	ok.False(skip.includes("name"))
+
+	update := matchExisting{columns: []string{"company_id", "email"}, action: MatchUpdate}
+	ok.Equal(`ON CONFLICT ("company_id", "email") DO UPDATE SET "company_id" = EXCLUDED."company_id", "email" = EXCLUDED."email", "name" = EXCLUDED."name"`, update.onConflict(keys, "id"))
+
+	byPK := matchExisting{columns: []string{"id"}, action: MatchUpdate}
+	ok.Equal(`ON CONFLICT ("id") DO UPDATE SET "id" = EXCLUDED."id"`, byPK.onConflict([]string{`"id"`}, "id"))
+}
+
+func TestResolveReference(t *testing.T) {
+	ok := assert.New(t)
+	fk := ForeignKey{BaseTable: "company", BaseCol: "id", ReferencingTable: "user", ReferencingCol: "company_id"}
+	row := map[string]any{DumpTableKey: "user", "id": 7, "company_id": 3}
+	db := pgtx{pgdb: pgdb{pkGroups: map[string]getPrimaryKeysRow{"user": {TableName: "user", ColumnName: "id"}}}}
+
+	unresolved := UnresolvedReferencesError{}
+	v, handled := db.resolveReference(fk, row, 3, &unresolved)
+	ok.False(handled)
+	ok.Equal(3, v)
+
+	OnUnresolvedReference("user", "company_id", NullReference)(&db)
+	v, handled = db.resolveReference(fk, row, 3, &unresolved)
+	ok.True(handled)
+	ok.Nil(v)
+
+	OnUnresolvedReference("user", "company_id", ReplaceReference(42))(&db)
+	v, handled = db.resolveReference(fk, row, 3, &unresolved)
+	ok.True(handled)
+	ok.Equal(42, v)
+	ok.Empty(unresolved.References)
+
+	OnUnresolvedReference("user", "company_id", FailReference)(&db)
+	_, handled = db.resolveReference(fk, row, 3, &unresolved)
+	ok.True(handled)
+	ok.Len(unresolved.References, 1)
+	ok.Equal(RecordID{Table: "user", PrimaryKey: 7}, unresolved.References[0].Row)
+	ok.Equal("1 unresolved references: user(7).company_id references company(3)", unresolved.Error())
+}
+
+func TestUniqueColumns(t *testing.T) {
+	ok := assert.New(t)
+	pks := map[string]getPrimaryKeysRow{"user": {TableName: "user", ColumnName: "id"}}
+	fks := []ForeignKey{{BaseTable: "company", BaseCol: "id", ReferencingTable: "user", ReferencingCol: "company_id"}}
+	indexes := []getUniqueIndexesRow{
+		{TableName: "user", IndexName: "user_access_code_key", ColumnNames: []string{"access_code"}},
+		{TableName: "user", IndexName: "user_company_email_key", ColumnNames: []string{"company_id", "email"}},
+		{TableName: "user", IndexName: "user_id_slug_key", ColumnNames: []string{"id", "slug"}},
+	}
+	ok.Equal(map[string][]string{"user": {"access_code"}}, uniqueColumns(pks, fks, indexes))
+}
+
+func TestRewriteUniques(t *testing.T) {
+	ok := assert.New(t)
+	db := pgtx{pgdb: pgdb{uniques: map[string][]string{"user": {"access_code", "email"}}}}
+	RewriteUniques(SuffixUnique("-clone"))(&db)
+	RewriteUnique("user", "email", nil)(&db)
+	RewriteUnique("user", "token", NullUnique)(&db)
+
+	row := map[string]any{DumpTableKey: "user", "access_code": "abc", "email": "a@b.c", "token": "xyz", "name": nil}
+	ok.NoError(db.rewriteUniques(row))
+	ok.Equal(map[string]any{DumpTableKey: "user", "access_code": "abc-clone", "email": "a@b.c", "token": nil, "name": nil}, row)
+
+	_, err := SuffixUnique("-clone")("user", "code", int32(1))
+	ok.EqualError(err, "can't add a suffix to user.code, which is a int32")
+
+	id, err := RandomUnique("user", "uuid", "6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	ok.NoError(err)
+	ok.True(isUUID(id.(string)))
+	ok.NotEqual("6ba7b810-9dad-11d1-80b4-00c04fd430c8", id)
+
+	code, err := RandomUnique("user", "access_code", "abc")
+	ok.NoError(err)
+	ok.Len(code, 16)
+
+	n, err := RandomUnique("user", "number", int16(5))
+	ok.NoError(err)
+	ok.IsType(int16(0), n)
+}
+
+func TestUploadProgress(t *testing.T) {
+	ok := assert.New(t)
+	reports := []UploadProgress{}
+	db := pgtx{}
+	ReportProgress(func(p UploadProgress) { reports = append(reports, p) })(&db)
+
+	progress := db.newProgress(2500)
+	for i := 0; i < 2500; i++ {
+		progress.queued()
+	}
+	ok.Len(reports, 2)
+	ok.Equal(2000, reports[1].Queued)
+
+	progress.executed("user", 1500)
+	progress.executed("company", 1000)
+	ok.Len(reports, 4)
+	ok.Equal(2500, reports[3].ExecutedRows())
+	ok.Equal(map[string]int{"user": 1500, "company": 1000}, reports[3].Executed)
+
+	progress.done()
+	ok.Len(reports, 5)
+	ok.True(reports[4].Done)
+
+	// without a callback, nothing is reported
+	pgtx{}.newProgress(1).done()
+}
+
+func TestChunkHelpers(t *testing.T) {
+	ok := assert.New(t)
+	db := pgdb{
+		pkGroups: map[string]getPrimaryKeysRow{
+			"post": {TableName: "post", ColumnName: "id"},
+			"user": {TableName: "user", ColumnName: "id"},
+		},
+		fks: []ForeignKey{
+			{BaseTable: "post", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "reply_to_id"},
+			{BaseTable: "user", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "user_id"},
+		},
+	}
+	rows := []map[string]any{
+		{DumpTableKey: "user", "id": 1},
+		{DumpTableKey: "post", "id": 2, "user_id": 1},
+		{DumpTableKey: "post", "id": 3, "user_id": 1, "reply_to_id": 2},
+	}
+	ok.Equal(map[string]bool{"post\x002": true, "post\x003": true}, db.patchTargets(rows))
+
+	err := ChunkError{Offset: 500, Err: fmt.Errorf("boom")}
+	ok.EqualError(err, "uploading rows from 500: boom")
+	ok.EqualError(errors.Unwrap(err), "boom")
+}
+
+func TestBreakCycles(t *testing.T) {
+	ok := assert.New(t)
+	primaryContact := ForeignKey{BaseTable: "contact", BaseCol: "id", ReferencingTable: "company", ReferencingCol: "primary_contact_id"}
+	company := ForeignKey{BaseTable: "company", BaseCol: "id", ReferencingTable: "contact", ReferencingCol: "company_id"}
+	manager := ForeignKey{BaseTable: "contact", BaseCol: "id", ReferencingTable: "contact", ReferencingCol: "manager_id"}
+	owner := ForeignKey{BaseTable: "user", BaseCol: "id", ReferencingTable: "company", ReferencingCol: "owner_id"}
+	options := []getForeignKeyOptionsRow{
+		{ReferencingTable: "company", ReferencingCol: "primary_contact_id", ConstraintName: "company_primary_contact_id_fkey", Nullable: true},
+		{ReferencingTable: "contact", ReferencingCol: "company_id", ConstraintName: "contact_company_id_fkey"},
+		{ReferencingTable: "contact", ReferencingCol: "manager_id", ConstraintName: "contact_manager_id_fkey", Nullable: true},
+		{ReferencingTable: "company", ReferencingCol: "owner_id", ConstraintName: "company_owner_id_fkey"},
+	}
+
+	// the nullable reference is patched, whichever order the foreign keys come in
+	want := map[ForeignKey]getForeignKeyOptionsRow{primaryContact: options[0]}
+	ok.Equal(want, breakCycles([]ForeignKey{primaryContact, company, manager, owner}, options))
+	ok.Equal(want, breakCycles([]ForeignKey{company, owner, manager, primaryContact}, options))
+
+	ok.Empty(breakCycles([]ForeignKey{company, manager, owner}, options))
+
+	db := pgdb{fks: []ForeignKey{primaryContact, company, manager, owner}, cycles: want}
+	ok.Equal([]ForeignKey{primaryContact}, db.DeferredForeignKeys())
+	ok.Equal([]ForeignKey{company, manager, owner}, db.withoutCycles())
+}
+
+func TestWritableColumns(t *testing.T) {
+	ok := assert.New(t)
+	db := pgtx{pgdb: pgdb{columns: map[string]map[string]getColumnsRow{"invoice": {
+		"id":       {ColumnName: "id", Identity: "a"},
+		"number":   {ColumnName: "number", Identity: "a"},
+		"total":    {ColumnName: "total", Generated: "s"},
+		"position": {ColumnName: "position", Identity: "d"},
+		"amount":   {ColumnName: "amount"},
+	}}}}
+
+	write := func(col string) [2]bool {
+		w, o := db.writable("invoice", col, "id")
+		return [2]bool{w, o}
+	}
+	ok.Equal([2]bool{true, true}, write("id"))
+	ok.Equal([2]bool{false, false}, write("number"))
+	ok.Equal([2]bool{false, false}, write("total"))
+	ok.Equal([2]bool{true, false}, write("position"))
+	ok.Equal([2]bool{true, false}, write("amount"))
+	ok.Equal([2]bool{true, false}, write("unknown"))
+
+	PreserveIDs()(&db)
+	ok.Equal([2]bool{true, true}, write("number"))
+	ok.Equal([2]bool{false, false}, write("total"))
+}
+
+// recordingConn records the statements it is sent, and answers each QueryRow with the next of `rows`, or with `row`.
+// Queries are answered by `query`, if it's set. Batches are recorded by their number of statements,
+// and the statement numbered `failAt`, counting from 1 across batches, fails.
+// Like a real connection, nothing else can be sent while a batch is open.
+type recordingConn struct {
+	Postgreser
+	execs   []string
+	row     []any
+	rows    [][]any
+	query   func(sql string, args []any) *recordedRows
+	failAt  int
+	batched int
+	busy    bool
+}
+
+func (c *recordingConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	if c.busy {
+		return nil, fmt.Errorf("conn busy")
+	}
+	c.execs = append(c.execs, strings.TrimSpace(fmt.Sprint(sql, args)))
+	return pgconn.CommandTag("SELECT 1"), nil
+}
+
+func (c *recordingConn) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	c.execs = append(c.execs, fmt.Sprintf("batch of %d", b.Len()))
+	c.busy = true
+	return recordedBatch{conn: c}
+}
+
+func (c *recordingConn) CopyFrom(ctx context.Context, table pgx.Identifier, cols []string, src pgx.CopyFromSource) (int64, error) {
+	var rows [][]any
+	for src.Next() {
+		vals, err := src.Values()
+		if err != nil {
+			return 0, err
+		}
+		rows = append(rows, vals)
+	}
+	c.execs = append(c.execs, fmt.Sprint("copy ", table, cols, rows))
+	return int64(len(rows)), nil
+}
+
+type recordedBatch struct {
+	pgx.BatchResults
+	conn *recordingConn
+}
+
+func (b recordedBatch) Exec() (pgconn.CommandTag, error) {
+	b.conn.batched++
+	if b.conn.batched == b.conn.failAt {
+		return nil, fmt.Errorf("boom")
+	}
+	return pgconn.CommandTag("INSERT 0 1"), nil
+}
+
+func (b recordedBatch) Close() error {
+	b.conn.busy = false
+	return nil
+}
+
+func (c *recordingConn) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	if len(c.rows) > 0 {
+		c.execs = append(c.execs, strings.TrimSpace(fmt.Sprint(sql, args)))
+		row := c.rows[0]
+		c.rows = c.rows[1:]
+		return recordedRow(row)
+	}
+	return recordedRow(c.row)
+}
+
+func (c *recordingConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	c.execs = append(c.execs, sql)
+	return c.query(sql, args), nil
+}
+
+type recordedRow []any
+
+func (r recordedRow) Scan(dest ...any) error {
+	for i, d := range dest {
+		reflect.ValueOf(d).Elem().Set(reflect.ValueOf(r[i]))
+	}
+	return nil
+}
+
+// recordedRows are the rows of a query, with `fields` naming their columns.
+type recordedRows struct {
+	pgx.Rows
+	fields []string
+	values [][]any
+	next   int
+}
+
+func (r *recordedRows) FieldDescriptions() []pgproto3.FieldDescription {
+	desc := make([]pgproto3.FieldDescription, len(r.fields))
+	for i, f := range r.fields {
+		desc[i] = pgproto3.FieldDescription{Name: []byte(f)}
+	}
+	return desc
+}
+
+func (r *recordedRows) Next() bool {
+	r.next++
+	return r.next <= len(r.values)
+}
+
+func (r *recordedRows) Values() ([]any, error) { return r.values[r.next-1], nil }
+func (r *recordedRows) Err() error             { return nil }
+func (r *recordedRows) Close()                 {}
+
+func TestSelectMatchingRows(t *testing.T) {
+	ok := assert.New(t)
+	ids := make([]any, 2*lookupChunkSize+1)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	var sizes []int
+	conn := &recordingConn{query: func(sql string, args []any) *recordedRows {
+		sizes = append(sizes, len(args))
+		rows := &recordedRows{fields: []string{"id", "email"}}
+		for _, a := range args {
+			// user 1 matches both by id and by email
+			if a == 1 || a == "a@example.com" {
+				rows.values = append(rows.values, []any{int32(1), "a@example.com"})
+			}
+		}
+		return rows
+	}}
+	db, err := pgdb{
+		pkGroups: map[string]getPrimaryKeysRow{"user": {TableName: "user", ColumnName: "id"}},
+		builder:  squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+	}.NewClient(context.Background(), conn)
+	ok.NoError(err)
+
+	found, err := db.SelectMatchingRows("user", map[string][]any{"id": ids, "email": {"a@example.com"}})
+	ok.NoError(err)
+	ok.Equal([]map[string]any{{DumpTableKey: "user", "id": int32(1), "email": "a@example.com"}}, found)
+
+	// each column is looked up separately, with at most lookupChunkSize values at a time
+	ok.Equal([]int{1, lookupChunkSize, lookupChunkSize, 1}, sizes)
+	ok.Equal(`SELECT * FROM "user" WHERE email IN ($1)`, conn.execs[0])
+	ok.True(strings.HasSuffix(conn.execs[2], fmt.Sprintf("$%d)", lookupChunkSize)))
+}
+
+func TestChunkedInsert(t *testing.T) {
+	ok := assert.New(t)
+	conn := &recordingConn{failAt: 3, query: func(sql string, args []any) *recordedRows { return &recordedRows{} }}
+	db, err := pgdb{
+		pkGroups: map[string]getPrimaryKeysRow{
+			"user": {TableName: "user", ColumnName: "id", ColumnType: "integer"},
+			"post": {TableName: "post", ColumnName: "id", ColumnType: "integer"},
+		},
+		fks:     []ForeignKey{{BaseTable: "user", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "user_id"}},
+		builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+	}.NewBatchClient(context.Background(), conn, ChunkSize(2))
+	ok.NoError(err)
+	rows := []map[string]any{
+		{DumpTableKey: "user", "id": 1},
+		{DumpTableKey: "user", "id": 2},
+		{DumpTableKey: "post", "id": 3, "user_id": 1},
+	}
+
+	// a failed chunk is rolled back to its savepoint once its batch is closed, keeping the chunks before it
+	err = db.Insert(rows...)
+	ok.EqualError(err, "uploading rows from 2: batch query 0 error: boom")
+	ok.Equal([]string{"SAVEPOINT datapasta_chunk[]", "batch of 2", "batch of 0", "RELEASE SAVEPOINT datapasta_chunk[]",
+		"SAVEPOINT datapasta_chunk[]", "batch of 1", "ROLLBACK TO SAVEPOINT datapasta_chunk[]"}, conn.execs[2:])
+
+	// and the upload resumes from there
+	conn.execs = nil
+	ok.NoError(db.Insert(rows[2:]...))
+	ok.Equal([]string{"batch of 1", "batch of 0"}, conn.execs[2:])
+
+	// unresolved references fail the upload before the first chunk is inserted, even if they're in a later chunk
+	conn.execs = nil
+	OnUnresolvedReference("post", "user_id", FailReference)(&db.pgtx)
+	err = db.Insert(append(rows[:2:2], map[string]any{DumpTableKey: "post", "id": 4, "user_id": 99})...)
+	ok.Equal(UnresolvedReferencesError{References: []UnresolvedReference{{
+		ForeignKey: ForeignKey{BaseTable: "user", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "user_id"},
+		Row:        RecordID{Table: "post", PrimaryKey: 4},
+		Value:      99,
+	}}}, err)
+	ok.NotContains(conn.execs, "SAVEPOINT datapasta_chunk[]")
+}
+
+func TestPersistMapping(t *testing.T) {
+	ok := assert.New(t)
+	conn := &recordingConn{}
+	db, err := pgdb{
+		pkGroups: map[string]getPrimaryKeysRow{"user": {TableName: "user", ColumnName: "id", ColumnType: "integer"}},
+		builder:  squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+	}.NewBatchClient(context.Background(), conn, PersistMapping("sandbox"))
+	ok.NoError(err)
+
+	// each Insert only persists the mapping of its own rows
+	ok.NoError(db.Insert(map[string]any{DumpTableKey: "user", "id": 1}, map[string]any{DumpTableKey: "user", "id": 2}))
+	ok.NoError(db.Insert(map[string]any{DumpTableKey: "user", "id": 3}))
+	persisted := []string{}
+	for _, e := range conn.execs {
+		if strings.HasPrefix(e, "INSERT INTO datapasta_mapping") {
+			persisted = append(persisted, e[strings.Index(e, "[sandbox"):])
+		}
+	}
+	ok.Equal([]string{"[sandbox [user user] [1 2]]", "[sandbox [user] [3]]"}, persisted)
+}
+
+func TestWithoutTriggers(t *testing.T) {
+	ok := assert.New(t)
+	conn := &recordingConn{rows: [][]any{{"origin"}, {"replica"}}}
+	db, err := pgdb{}.NewBatchClient(context.Background(), conn, BypassTriggers(), DisableTriggers("user", "audit", "notify"))
+	ok.NoError(err)
+
+	ok.EqualError(db.withoutTriggers(func() error {
+		conn.execs = append(conn.execs, "insert")
+		return fmt.Errorf("boom")
+	}), "boom")
+	ok.Equal([]string{
+		"SELECT current_setting('session_replication_role')[]",
+		"SELECT set_config('session_replication_role', 'replica', true)[]",
+		"SELECT current_setting('session_replication_role')[]",
+		`ALTER TABLE "user" DISABLE TRIGGER "audit"[]`,
+		`ALTER TABLE "user" DISABLE TRIGGER "notify"[]`,
+		"insert",
+		`ALTER TABLE "user" ENABLE TRIGGER "notify"[]`,
+		`ALTER TABLE "user" ENABLE TRIGGER "audit"[]`,
+		"SELECT set_config('session_replication_role', $1, true)[origin]",
+	}, conn.execs)
+
+	// outside of a transaction, the role is reset right away, so nothing is inserted
+	conn = &recordingConn{row: []any{"origin"}}
+	db, err = pgdb{}.NewBatchClient(context.Background(), conn, BypassTriggers())
+	ok.NoError(err)
+	ok.EqualError(db.withoutTriggers(func() error {
+		conn.execs = append(conn.execs, "insert")
+		return nil
+	}), "bypassing triggers needs the client to be given a transaction")
+	ok.NotContains(conn.execs, "insert")
+}
+
+// snapshotConn begins a snapshotTx, whose statements fail with `err`.
+type snapshotConn struct {
+	tx   *snapshotTx
+	opts pgx.TxOptions
+}
+
+func (c *snapshotConn) BeginTx(ctx context.Context, opts pgx.TxOptions) (pgx.Tx, error) {
+	c.opts = opts
+	return c.tx, nil
+}
+
+type snapshotTx struct {
+	pgx.Tx
+	execs      []string
+	err        error
+	rolledBack bool
+}
+
+func (t *snapshotTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	t.execs = append(t.execs, sql)
+	return pgconn.CommandTag("SET"), t.err
+}
+
+func (t *snapshotTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	t.execs = append(t.execs, sql)
+	if t.err != nil {
+		return failedRow{t.err}
+	}
+	return recordedRow{"00000003-0000001B-1"}
+}
+
+func (t *snapshotTx) Rollback(ctx context.Context) error {
+	t.rolledBack = true
+	return nil
+}
+
+type failedRow struct{ error }
+
+func (r failedRow) Scan(dest ...any) error { return r.error }
+
+func TestBeginSnapshot(t *testing.T) {
+	ok := assert.New(t)
+	ctx := context.Background()
+
+	// without an id, the snapshot of the new transaction is exported
+	conn := &snapshotConn{tx: &snapshotTx{}}
+	tx, id, err := BeginSnapshot(ctx, conn, "")
+	ok.NoError(err)
+	ok.Equal(conn.tx, tx)
+	ok.Equal("00000003-0000001B-1", id)
+	ok.Equal(pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, conn.opts)
+	ok.Equal([]string{"SELECT pg_export_snapshot()"}, conn.tx.execs)
+
+	// with an id, it's imported, quoted as a literal
+	conn = &snapshotConn{tx: &snapshotTx{}}
+	_, id, err = BeginSnapshot(ctx, conn, "0000'0003")
+	ok.NoError(err)
+	ok.Equal("0000'0003", id)
+	ok.Equal([]string{"SET TRANSACTION SNAPSHOT '0000''0003'"}, conn.tx.execs)
+	ok.False(conn.tx.rolledBack)
+
+	// transactions are rolled back when the snapshot can't be exported or imported
+	conn = &snapshotConn{tx: &snapshotTx{err: fmt.Errorf("boom")}}
+	_, _, err = BeginSnapshot(ctx, conn, "")
+	ok.EqualError(err, "exporting snapshot: boom")
+	ok.True(conn.tx.rolledBack)
+
+	conn = &snapshotConn{tx: &snapshotTx{err: fmt.Errorf("invalid snapshot identifier")}}
+	tx, _, err = BeginSnapshot(ctx, conn, "nope")
+	ok.EqualError(err, "importing snapshot nope: invalid snapshot identifier")
+	ok.Nil(tx)
+	ok.True(conn.tx.rolledBack)
+}
+
+func TestClientInsert(t *testing.T) {
+	ok := assert.New(t)
+	db := pgdb{
+		pkGroups: map[string]getPrimaryKeysRow{
+			"user": {TableName: "user", ColumnName: "id", ColumnType: "integer"},
+			"post": {TableName: "post", ColumnName: "id", ColumnType: "integer"},
+		},
+		fks: []ForeignKey{
+			{BaseTable: "user", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "user_id"},
+			{BaseTable: "post", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "reply_to_id"},
+		},
+		builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+	}
+	conn := &recordingConn{rows: [][]any{{int32(101)}, {int32(110)}, {int32(111)}}}
+	cli, err := db.NewClient(context.Background(), conn)
+	ok.NoError(err)
+
+	user := map[string]any{DumpTableKey: "user", "id": 1}
+	reply := map[string]any{DumpTableKey: "post", "id": 10, "user_id": 1, "reply_to_id": 11}
+	post := map[string]any{DumpTableKey: "post", "id": 11, "user_id": 1}
+	ok.NoError(cli.Insert(user, reply, post))
+
+	// primary keys are updated in place, and the reply is patched once the post it replies to exists
+	ok.Equal(int32(101), user["id"])
+	ok.Equal(int32(110), reply["id"])
+	ok.Equal(int32(111), post["id"])
+	ok.Equal([]string{
+		`INSERT INTO "user" DEFAULT VALUES RETURNING "id"[]`,
+		`INSERT INTO "post" ("user_id") VALUES ($1) RETURNING "id"[101]`,
+		`INSERT INTO "post" ("user_id") VALUES ($1) RETURNING "id"[101]`,
+		`UPDATE "post" SET "reply_to_id" = $1 WHERE ("id" = $2)[111 110]`,
+	}, conn.execs)
+
+	mapping, err := cli.Mapping()
+	ok.NoError(err)
+	ok.Equal([]Mapping{
+		{RecordID: RecordID{Table: "user", PrimaryKey: int32(101)}, OriginalID: 1},
+		{RecordID: RecordID{Table: "post", PrimaryKey: int32(110)}, OriginalID: 10},
+		{RecordID: RecordID{Table: "post", PrimaryKey: int32(111)}, OriginalID: 11},
+	}, mapping)
+
+	// options of the batching client are rejected rather than ignored
+	_, err = db.NewClient(context.Background(), conn, BulkCopy())
+	ok.EqualError(err, "BulkCopy can only be used with NewBatchClient")
+	_, err = db.NewClient(context.Background(), conn, ChunkSize(100))
+	ok.EqualError(err, "ChunkSize can only be used with NewBatchClient")
+}
+
+func TestClientInsertCycle(t *testing.T) {
+	ok := assert.New(t)
+	owner := ForeignKey{BaseTable: "person", BaseCol: "id", ReferencingTable: "company", ReferencingCol: "owner_id"}
+	db := pgdb{
+		pkGroups: map[string]getPrimaryKeysRow{
+			"company": {TableName: "company", ColumnName: "id", ColumnType: "integer"},
+			"person":  {TableName: "person", ColumnName: "id", ColumnType: "integer"},
+		},
+		fks:     []ForeignKey{owner, {BaseTable: "company", BaseCol: "id", ReferencingTable: "person", ReferencingCol: "company_id"}},
+		cycles:  map[ForeignKey]getForeignKeyOptionsRow{owner: {ConstraintName: "company_owner_fk", Deferrable: true}},
+		builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+	}
+	conn := &recordingConn{rows: [][]any{{int32(101)}, {int32(102)}, {int32(105)}, {int32(106)}}}
+	cli, err := db.NewClient(context.Background(), conn)
+	ok.NoError(err)
+
+	// NOT NULL references to later rows keep their value until they're patched, and their constraint is deferred once
+	ok.NoError(cli.Insert(
+		map[string]any{DumpTableKey: "company", "id": 1, "owner_id": 5},
+		map[string]any{DumpTableKey: "company", "id": 2, "owner_id": 6},
+		map[string]any{DumpTableKey: "person", "id": 5, "company_id": 1},
+		map[string]any{DumpTableKey: "person", "id": 6, "company_id": 2},
+	))
+	ok.Equal([]string{
+		`SET CONSTRAINTS "company_owner_fk" DEFERRED[]`,
+		`INSERT INTO "company" ("owner_id") VALUES ($1) RETURNING "id"[5]`,
+		`INSERT INTO "company" ("owner_id") VALUES ($1) RETURNING "id"[6]`,
+		`INSERT INTO "person" ("company_id") VALUES ($1) RETURNING "id"[101]`,
+		`INSERT INTO "person" ("company_id") VALUES ($1) RETURNING "id"[102]`,
+		`UPDATE "company" SET "owner_id" = $1 WHERE ("id" = $2)[105 101]`,
+		`UPDATE "company" SET "owner_id" = $1 WHERE ("id" = $2)[106 102]`,
+	}, conn.execs)
+
+	// and cycles through NOT NULL columns that can't be deferred can't be broken
+	db.cycles[owner] = getForeignKeyOptionsRow{ConstraintName: "company_owner_fk"}
+	cli, err = db.NewClient(context.Background(), conn)
+	ok.NoError(err)
+	ok.EqualError(cli.Insert(
+		map[string]any{DumpTableKey: "company", "id": 1, "owner_id": 5},
+		map[string]any{DumpTableKey: "person", "id": 5, "company_id": 1},
+	), "can't break the foreign key cycle through company.owner_id, as it is NOT NULL and company_owner_fk is not DEFERRABLE")
+}
+
+func TestAdvanceSequences(t *testing.T) {
+	ok := assert.New(t)
+	serial := func(seq string) *string {
+		def := "nextval('" + seq + "'::regclass)"
+		return &def
+	}
+	uuid := "gen_random_uuid()"
+	conn := &recordingConn{}
+	db, err := pgdb{
+		pkGroups: map[string]getPrimaryKeysRow{"user": {TableName: "user", ColumnName: "id", ColumnType: "uuid"}},
+		columns: map[string]map[string]getColumnsRow{
+			"user": {
+				"id":     {ColumnType: "uuid", Default: &uuid},
+				"number": {ColumnType: "integer", Default: serial("user_number_seq")},
+				"ticket": {ColumnType: "bigint", Identity: "a"},
+				"code":   {ColumnType: "text", Default: serial("user_code_seq")},
+			},
+			"tag": {"name": {ColumnType: "text"}},
+		},
+	}.NewClient(context.Background(), conn, PreserveIDs())
+	ok.NoError(err)
+
+	// only integer columns filled from a sequence are advanced, whether or not they're the primary key
+	ok.NoError(db.advanceSequences([]map[string]any{
+		{DumpTableKey: "user", "id": "6ba7b810-9dad-11d1-80b4-00c04fd430c8", "number": 4, "ticket": 7},
+		{DumpTableKey: "user", "id": "6ba7b811-9dad-11d1-80b4-00c04fd430c8", "number": 5, "ticket": 8},
+		{DumpTableKey: "tag", "name": "a"},
+	}))
+	ok.Len(conn.execs, 2)
+	ok.Contains(conn.execs[0], `SELECT setval(s, GREATEST((SELECT max("number") FROM "user"), pg_sequence_last_value(s::regclass)))`)
+	ok.True(strings.HasSuffix(conn.execs[0], `FROM pg_get_serial_sequence($1, $2) s WHERE s IS NOT NULL["user" number]`))
+	ok.Contains(conn.execs[1], `SELECT setval(s, GREATEST((SELECT max("ticket") FROM "user")`)
+	ok.True(strings.HasSuffix(conn.execs[1], `["user" ticket]`))
+}
+
+func TestPrimaryKeyColumns(t *testing.T) {
+	ok := assert.New(t)
+	conn := &recordingConn{rows: [][]any{{"acme", int64(2)}, {"ab12"}}}
+	db, err := pgdb{
+		pkGroups: map[string]getPrimaryKeysRow{"account": {TableName: "account", ColumnName: "code"}},
+		pkColumns: map[string][]string{
+			"account":    {"code"},
+			"membership": {"account_code", "seq"},
+		},
+		builder: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+	}.NewClient(context.Background(), conn)
+	ok.NoError(err)
+
+	id, err := db.InsertRecord(map[string]any{DumpTableKey: "membership", "account_code": "acme", "seq": nil})
+	ok.NoError(err)
+	ok.Equal([]any{"acme", int64(2)}, id)
+	id, err = db.InsertRecord(map[string]any{DumpTableKey: "account", "code": "ab12"})
+	ok.NoError(err)
+	ok.Equal("ab12", id)
+
+	ok.NoError(db.Update(RecordID{Table: "account", PrimaryKey: "ab12"}, map[string]any{"name": "Acme"}))
+	ok.NoError(db.Delete(RecordID{Table: "membership", PrimaryKey: []any{"acme", 2}}))
+	ok.NoError(db.Delete(RecordID{Table: "membership", PrimaryKey: map[string]any{"seq": 2, "account_code": "acme"}}))
+	ok.Equal([]string{
+		`INSERT INTO "membership" ("account_code") VALUES ($1) RETURNING "account_code", "seq"[acme]`,
+		`INSERT INTO "account" ("code") VALUES ($1) RETURNING "code"[ab12]`,
+		`UPDATE "account" SET name = $1 WHERE "code" = $2[Acme ab12]`,
+		`DELETE FROM "membership" WHERE "account_code" = $1 AND "seq" = $2[acme 2]`,
+		`DELETE FROM "membership" WHERE "account_code" = $1 AND "seq" = $2[acme 2]`,
+	}, conn.execs)
+
+	ok.EqualError(db.Delete(RecordID{Table: "membership", PrimaryKey: "acme"}), "membership has a composite primary key, which must be given as a []any or map[string]any, not string")
+	ok.EqualError(db.Update(RecordID{Table: "log", PrimaryKey: 1}, map[string]any{"msg": "hi"}), "no primary key for log")
+	_, err = db.InsertRecord(map[string]any{DumpTableKey: "log", "msg": "hi"})
+	ok.EqualError(err, "no primary key for log")
+}
+
+func TestInheritedTables(t *testing.T) {
+	ok := assert.New(t)
+	conn := &recordingConn{}
+	db, err := pgdb{
+		pkGroups:  map[string]getPrimaryKeysRow{"event": {TableName: "event", ColumnName: "id"}, "measurement": {TableName: "measurement", ColumnName: "id"}},
+		inherited: map[string]bool{"event": true},
+		builder:   squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+	}.NewClient(context.Background(), conn)
+	ok.NoError(err)
+
+	// rows of tables inheriting from event are left alone, while partitioned tables like measurement are used directly
+	ok.NoError(db.Delete(RecordID{Table: "event", PrimaryKey: 1}))
+	ok.NoError(db.Update(RecordID{Table: "event", PrimaryKey: 1}, map[string]any{"kind": "login"}))
+	ok.NoError(db.Delete(RecordID{Table: "measurement", PrimaryKey: 2}))
+	ok.Equal([]string{
+		`DELETE FROM ONLY "event" WHERE "id" = $1[1]`,
+		`UPDATE ONLY "event" SET kind = $1 WHERE "id" = $2[login 1]`,
+		`DELETE FROM "measurement" WHERE "id" = $1[2]`,
+	}, conn.execs)
+}
+
+func TestUserDefinedTypes(t *testing.T) {
+	ok := assert.New(t)
+	db := pgdb{
+		columns: map[string]map[string]getColumnsRow{
+			"user": {
+				"id":      {ColumnType: "integer"},
+				"moods":   {ColumnType: "mood[]", UserDefined: true},
+				"address": {ColumnType: "address", UserDefined: true},
+				"floor":   {ColumnType: "floor"},
+			},
+			"post": {"id": {ColumnType: "integer"}},
+		},
+		userTypes: []getUserTypesRow{
+			{OID: 90001, TypeName: "mood", Kind: "e", ArrayOID: 90002},
+			{OID: 90003, TypeName: "address", Kind: "c", ArrayOID: 90004, FieldNames: []string{"street", "mood", "floor"}, FieldOIDs: []uint32{pgtype.TextOID, 90001, 90005}},
+			{OID: 90005, TypeName: "floor", Kind: "d", BaseOID: pgtype.Int4OID},
+		},
+	}
+
+	// enum and composite values are downloaded as text, and cast back when inserted, while domains are left as they are
+	ok.Equal([]string{`"address"::text AS "address"`, `"floor"`, `"id"`, `"moods"::text AS "moods"`}, db.selectColumns("user"))
+	ok.Equal([]string{"*"}, db.selectColumns("post"))
+	sql, args, err := db.castValue("user", "moods", "{happy,sad}").(squirrel.Sqlizer).ToSql()
+	ok.NoError(err)
+	ok.Equal("?::mood[]", sql)
+	ok.Equal([]any{"{happy,sad}"}, args)
+	ok.Equal(3, db.castValue("user", "id", 3))
+	ok.Equal("3", db.castValue("user", "floor", "3"))
+
+	// COPY needs them in their binary format
+	ci, err := db.connInfo()
+	ok.NoError(err)
+	for oid, text := range map[uint32]string{90002: "{happy,sad}", 90003: "(Main St,happy,3)", 90004: `{"(Main St,happy,3)","(Side St,sad,)"}`} {
+		v, err := copyValue(ci, oid, text)
+		ok.NoError(err)
+		out, err := v.(pgtype.TextEncoder).EncodeText(ci, nil)
+		ok.NoError(err)
+		ok.Equal(text, string(out))
+		_, err = v.(pgtype.BinaryEncoder).EncodeBinary(ci, nil)
+		ok.NoError(err)
+	}
+}
@@ -0,0 +1,78 @@
+package datapasta
+
+import (
+	"fmt"
+	"sort"
+)
+
+// BypassTriggers makes Insert run with session_replication_role set to replica, so that no ordinary triggers fire
+// for the inserted rows. The previous role is restored once Insert returns.
+// Foreign keys are enforced by triggers too, so they aren't checked either. This needs superuser, or on postgres 15+,
+// the SET privilege on session_replication_role.
+// The role is only set for the current transaction, so the client must be given one: Insert fails otherwise.
+func BypassTriggers() ClientOpt {
+	return func(db *pgtx) {
+		db.bypassTriggers = true
+	}
+}
+
+// DisableTriggers makes Insert disable the named triggers of `table`, and enable them again once Insert returns.
+// Disabling a trigger locks the table until the transaction ends, and needs ownership of the table.
+func DisableTriggers(table string, triggers ...string) ClientOpt {
+	return func(db *pgtx) {
+		if db.disabledTriggers == nil {
+			db.disabledTriggers = map[string][]string{}
+		}
+		db.disabledTriggers[table] = append(db.disabledTriggers[table], triggers...)
+	}
+}
+
+// withoutTriggers runs `f` with triggers bypassed or disabled as configured, restoring them afterwards.
+// Restoring is attempted even if `f` fails, as the transaction may still be usable (for example after a ChunkError).
+func (db pgtx) withoutTriggers(f func() error) (err error) {
+	if !db.bypassTriggers && len(db.disabledTriggers) == 0 {
+		return f()
+	}
+
+	restore := func(sql string, args ...any) {
+		if _, restoreErr := db.tx.db.Exec(db.ctx, sql, args...); restoreErr != nil && err == nil {
+			err = fmt.Errorf("restoring triggers: %w", restoreErr)
+		}
+	}
+
+	if db.bypassTriggers {
+		var previous string
+		if err := db.tx.db.QueryRow(db.ctx, "SELECT current_setting('session_replication_role')").Scan(&previous); err != nil {
+			return err
+		}
+		if _, err := db.tx.db.Exec(db.ctx, "SELECT set_config('session_replication_role', 'replica', true)"); err != nil {
+			return fmt.Errorf("bypassing triggers: %w", err)
+		}
+		defer restore("SELECT set_config('session_replication_role', $1, true)", previous)
+
+		// outside of a transaction, the setting only lasted for the statement that set it
+		var current string
+		if err := db.tx.db.QueryRow(db.ctx, "SELECT current_setting('session_replication_role')").Scan(&current); err != nil {
+			return err
+		}
+		if current != "replica" {
+			return fmt.Errorf("bypassing triggers needs the client to be given a transaction")
+		}
+	}
+
+	tables := make([]string, 0, len(db.disabledTriggers))
+	for table := range db.disabledTriggers {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		for _, trigger := range db.disabledTriggers[table] {
+			if _, err := db.tx.db.Exec(db.ctx, `ALTER TABLE "`+table+`" DISABLE TRIGGER "`+trigger+`"`); err != nil {
+				return fmt.Errorf("disabling trigger %s on %s: %w", trigger, table, err)
+			}
+			defer restore(`ALTER TABLE "` + table + `" ENABLE TRIGGER "` + trigger + `"`)
+		}
+	}
+
+	return f()
+}
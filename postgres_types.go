@@ -0,0 +1,164 @@
+package datapasta
+
+import (
+	"context"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/jackc/pgtype"
+)
+
+// castValue casts values of columns with enum and composite types, which are downloaded as text, to the column's type.
+// Without the cast, values such as enum arrays and composites are sent as untyped text.
+func (db pgdb) castValue(table, col string, v any) any {
+	if _, ok := v.(string); !ok {
+		return v
+	}
+	c, ok := db.columns[table][col]
+	if !ok || !c.UserDefined {
+		return v
+	}
+	return squirrel.Expr("?::"+c.ColumnType, v)
+}
+
+// selectColumns returns the columns to select from `table`. Columns with enum and composite types are selected as text,
+// as pgx would otherwise return composites and arrays of them as lists of values, if they're registered on the connection.
+// Their values are cast back to the column's type when inserted.
+func (db pgdb) selectColumns(table string) []string {
+	userDefined := false
+	for _, c := range db.columns[table] {
+		userDefined = userDefined || c.UserDefined
+	}
+	if !userDefined {
+		return []string{"*"}
+	}
+	cols := make([]string, 0, len(db.columns[table]))
+	for _, col := range sortedKeys(db.columns[table]) {
+		if db.columns[table][col].UserDefined {
+			cols = append(cols, `"`+col+`"::text AS "`+col+`"`)
+		} else {
+			cols = append(cols, `"`+col+`"`)
+		}
+	}
+	return cols
+}
+
+// connInfo returns the types pgx needs to encode values for COPY, including the enum, domain and composite types
+// of the database, and arrays of them.
+func (db pgdb) connInfo() (*pgtype.ConnInfo, error) {
+	ci := pgtype.NewConnInfo()
+	register := func(t getUserTypesRow, value pgtype.ValueTranscoder) {
+		ci.RegisterDataType(pgtype.DataType{Value: value, Name: t.TypeName, OID: t.OID})
+		if t.ArrayOID != 0 {
+			ci.RegisterDataType(pgtype.DataType{
+				Value: pgtype.NewArrayType(t.TypeName+"[]", t.OID, func() pgtype.ValueTranscoder {
+					return pgtype.NewValue(value).(pgtype.ValueTranscoder)
+				}),
+				Name: t.TypeName + "[]",
+				OID:  t.ArrayOID,
+			})
+		}
+	}
+
+	// composites and domains can be made of other user-defined types, so types are registered once their parts are
+	pending := append([]getUserTypesRow{}, db.userTypes...)
+	for len(pending) > 0 {
+		next := pending[:0]
+		for _, t := range pending {
+			switch t.Kind {
+			case "e":
+				register(t, pgtype.NewEnumType(t.TypeName, nil))
+			case "d":
+				base, ok := ci.DataTypeForOID(t.BaseOID)
+				if !ok {
+					next = append(next, t)
+					continue
+				}
+				if value, ok := pgtype.NewValue(base.Value).(pgtype.ValueTranscoder); ok {
+					register(t, value)
+				}
+			case "c":
+				fields := make([]pgtype.CompositeTypeField, len(t.FieldNames))
+				known := true
+				for i, name := range t.FieldNames {
+					fields[i] = pgtype.CompositeTypeField{Name: name, OID: t.FieldOIDs[i]}
+					_, ok := ci.DataTypeForOID(t.FieldOIDs[i])
+					known = known && ok
+				}
+				if !known {
+					next = append(next, t)
+					continue
+				}
+				value, err := pgtype.NewCompositeType(t.TypeName, fields, ci)
+				if err != nil {
+					return nil, err
+				}
+				register(t, value)
+			}
+		}
+		if len(next) == len(pending) {
+			// the rest are made of types pgx can't encode, so they're left as text
+			break
+		}
+		pending = next
+	}
+	return ci, nil
+}
+
+const getUserTypes = `-- name: GetUserTypes :many
+SELECT
+	t.oid::bigint AS oid,
+	format_type(t.oid, NULL)::text AS type_name,
+	t.typtype::text AS kind,
+	t.typarray::bigint AS array_oid,
+	t.typbasetype::bigint AS base_oid,
+	COALESCE((SELECT array_agg(a.attname::text ORDER BY a.attnum) FROM pg_catalog.pg_attribute a
+		WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped), '{}')::text[] AS field_names,
+	COALESCE((SELECT array_agg(a.atttypid::bigint ORDER BY a.attnum) FROM pg_catalog.pg_attribute a
+		WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped), '{}')::bigint[] AS field_oids
+FROM pg_catalog.pg_type t
+	JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+	LEFT JOIN pg_catalog.pg_class c ON c.oid = t.typrelid
+WHERE
+	(t.typtype IN ('e', 'd') OR (t.typtype = 'c' AND c.relkind = 'c'))
+	AND n.nspname NOT IN ('pg_catalog', 'pg_toast', 'information_schema')
+ORDER BY t.oid
+`
+
+type getUserTypesRow struct {
+	OID      uint32 `json:"oid"`
+	TypeName string `json:"type_name"`
+	// Kind is "e" for enums, "d" for domains and "c" for composite types
+	Kind     string `json:"kind"`
+	ArrayOID uint32 `json:"array_oid"`
+	// BaseOID is the type a domain is based on
+	BaseOID uint32 `json:"base_oid"`
+	// FieldNames and FieldOIDs are the fields of a composite type
+	FieldNames []string `json:"field_names"`
+	FieldOIDs  []uint32 `json:"field_oids"`
+}
+
+func (q *postgresQueries) GetUserTypes(ctx context.Context) ([]getUserTypesRow, error) {
+	rows, err := q.db.Query(ctx, getUserTypes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []getUserTypesRow
+	for rows.Next() {
+		var i getUserTypesRow
+		var oid, arrayOID, baseOID int64
+		var fieldOIDs []int64
+		if err := rows.Scan(&oid, &i.TypeName, &i.Kind, &arrayOID, &baseOID, &i.FieldNames, &fieldOIDs); err != nil {
+			return nil, err
+		}
+		i.OID, i.ArrayOID, i.BaseOID = uint32(oid), uint32(arrayOID), uint32(baseOID)
+		for _, f := range fieldOIDs {
+			i.FieldOIDs = append(i.FieldOIDs, uint32(f))
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
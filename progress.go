@@ -0,0 +1,87 @@
+package datapasta
+
+import "time"
+
+// UploadProgress is a snapshot of how far an Insert has got.
+type UploadProgress struct {
+	// Queued is how many rows have been prepared to be inserted, out of Total.
+	Queued, Total int
+	// Executed is how many rows have been inserted, by table.
+	Executed map[string]int
+	// Followups is how many of the updates that patch self-referencing foreign keys are done, out of FollowupsQueued.
+	Followups, FollowupsQueued int
+	// Elapsed is the time since the Insert started.
+	Elapsed time.Duration
+	// Done is set on the last report of a successful Insert.
+	Done bool
+}
+
+// ExecutedRows is the total number of rows inserted so far.
+func (p UploadProgress) ExecutedRows() int {
+	n := 0
+	for _, c := range p.Executed {
+		n += c
+	}
+	return n
+}
+
+// progressInterval is how many rows are prepared or executed between progress reports.
+const progressInterval = 1000
+
+// ReportProgress makes Insert call `report` as it prepares and executes rows, at least every 1000 rows and at every stage.
+// The Executed map is reused between calls, so copy it if you need to keep it.
+func ReportProgress(report func(UploadProgress)) ClientOpt {
+	return func(db *pgtx) {
+		db.progress = report
+	}
+}
+
+// uploadProgress tracks the progress of one Insert, and reports it if ReportProgress was used.
+type uploadProgress struct {
+	UploadProgress
+	start        time.Time
+	report       func(UploadProgress)
+	executedRows int
+}
+
+func (db pgtx) newProgress(total int) *uploadProgress {
+	return &uploadProgress{
+		UploadProgress: UploadProgress{Total: total, Executed: map[string]int{}},
+		start:          time.Now(),
+		report:         db.progress,
+	}
+}
+
+// send reports the progress, unless `throttle` is set and the count `n` isn't on an interval.
+func (p *uploadProgress) send(throttle bool, n int) {
+	if p.report == nil || (throttle && n%progressInterval != 0) {
+		return
+	}
+	p.Elapsed = time.Since(p.start)
+	p.report(p.UploadProgress)
+}
+
+func (p *uploadProgress) queued() {
+	p.Queued++
+	p.send(true, p.Queued)
+}
+
+func (p *uploadProgress) executed(table string, n int) {
+	before := p.executedRows
+	p.executedRows += n
+	p.Executed[table] += n
+	// report whenever an interval is crossed
+	if p.executedRows/progressInterval != before/progressInterval {
+		p.send(false, 0)
+	}
+}
+
+func (p *uploadProgress) followedUp() {
+	p.Followups++
+	p.send(true, p.Followups)
+}
+
+func (p *uploadProgress) done() {
+	p.Done = true
+	p.send(false, 0)
+}
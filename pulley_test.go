@@ -1,8 +1,8 @@
 package datapasta
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"log"
 	"strings"
 	"testing"
@@ -61,9 +61,12 @@ func TestWithLocalPostgres(t *testing.T) {
 		log.Println("cloning", row[DumpTableKey], row["id"])
 	}
 
-	in, _ := json.Marshal(res)
-	out := make([]map[string]any, 0, len(res))
-	json.Unmarshal(in, &out)
+	schema := db.Schema()
+	buf := &bytes.Buffer{}
+	ok.NoError(WriteDump(buf, res, &schema))
+	out, source, err := ReadDump(buf)
+	ok.NoError(err)
+	ok.NoError(CheckSchema(out, *source, db.Schema()))
 
 	start := time.Now()
 
@@ -74,7 +77,7 @@ func TestWithLocalPostgres(t *testing.T) {
 	var newID int64
 	switch any(cli).(type) {
 	case pgbatchtx:
-		ok.NoError(tx.QueryRow(context.Background(), "SELECT clone_id FROM datapasta_clone WHERE original_id = $1 AND table_name = 'company'", company).Scan(&newID))
+		ok.NoError(tx.QueryRow(context.Background(), "SELECT clone_id::bigint FROM datapasta_clone WHERE original_id = $1::bigint::text AND table_name = 'company'", company).Scan(&newID))
 	case pgtx:
 		newID = int64(out[0]["id"].(int32))
 	}
@@ -164,10 +167,11 @@ func TestFullProcessWithRealDatabase(t *testing.T) {
 	}
 
 	cli, err := db.NewBatchClient(context.Background(), tx) // This client is used for cloning and reverse mapping
-	in, _ := json.Marshal(initial)
+	ok.NoError(err)
+	buf := &bytes.Buffer{}
+	ok.NoError(WriteDump(buf, initial, nil))
 	{
-		out := make([]map[string]any, 0, len(initial))
-		json.Unmarshal(in, &out)
+		out, _, err := ReadDump(buf)
 
 		log.Println("starting to insert company", company)
 		ok.NoError(err)
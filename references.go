@@ -0,0 +1,151 @@
+package datapasta
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReferencePolicy is what to do with a foreign key that references a row outside of the dump,
+// for example one excluded by DontInclude.
+type ReferencePolicy struct {
+	action      string
+	replacement any
+}
+
+var (
+	// KeepReference inserts the original value, which is only correct if the row exists in the destination.
+	// This is the default for every foreign key.
+	KeepReference = ReferencePolicy{action: "keep"}
+	// NullReference sets the reference to NULL.
+	NullReference = ReferencePolicy{action: "null"}
+	// FailReference fails the upload with an UnresolvedReferencesError listing every such reference.
+	FailReference = ReferencePolicy{action: "fail"}
+)
+
+// ReplaceReference points the reference at `id` in the destination instead.
+func ReplaceReference(id any) ReferencePolicy {
+	return ReferencePolicy{action: "replace", replacement: id}
+}
+
+// OnUnresolvedReference sets the policy for values of `table`.`column` that reference rows which are neither
+// in the uploaded dump nor mapped by an earlier Insert.
+func OnUnresolvedReference(table, column string, policy ReferencePolicy) ClientOpt {
+	return func(db *pgtx) {
+		if db.references == nil {
+			db.references = map[string]ReferencePolicy{}
+		}
+		db.references[table+"."+column] = policy
+	}
+}
+
+// UnresolvedReference is a row referencing a row outside of the dump.
+type UnresolvedReference struct {
+	ForeignKey
+	Row   RecordID
+	Value any
+}
+
+// UnresolvedReferencesError is returned when references with the FailReference policy can't be resolved.
+type UnresolvedReferencesError struct {
+	References []UnresolvedReference
+}
+
+func (e UnresolvedReferencesError) Error() string {
+	refs := make([]string, 0, len(e.References))
+	for _, r := range e.References {
+		refs = append(refs, fmt.Sprintf(`%s.%s references %s(%v)`, r.Row, r.ReferencingCol, r.BaseTable, r.Value))
+	}
+	return fmt.Sprintf("%d unresolved references: %s", len(refs), strings.Join(refs, ", "))
+}
+
+// resolveReference applies the policy for `fk` to a value that references a row outside of the dump.
+// It returns the value to insert, and whether the policy handled the reference.
+func (db pgtx) resolveReference(fk ForeignKey, row map[string]any, v any, unresolved *UnresolvedReferencesError) (any, bool) {
+	policy, ok := db.references[fk.ReferencingTable+"."+fk.ReferencingCol]
+	if !ok {
+		return v, false
+	}
+	switch policy.action {
+	case "null":
+		return nil, true
+	case "fail":
+		id := RecordID{Table: fk.ReferencingTable}
+		if pk, ok := db.pkGroups[fk.ReferencingTable]; ok {
+			id.PrimaryKey = row[pk.ColumnName]
+		}
+		unresolved.References = append(unresolved.References, UnresolvedReference{ForeignKey: fk, Row: id, Value: v})
+		return v, true
+	case "replace":
+		return policy.replacement, true
+	}
+	return v, false
+}
+
+// foreignValue applies the reference policies to the value `v` of `col` in `row`, if the column is a foreign key.
+// It returns the foreign key, the value to insert, whether the column is a foreign key, and whether the value
+// still references a row of a table with a primary key, which may have been mapped onto a clone.
+func (db pgtx) foreignValue(row map[string]any, col string, v any, resolved map[string]bool, unresolved *UnresolvedReferencesError) (ForeignKey, any, bool, bool) {
+	for _, fk := range db.fks {
+		if fk.ReferencingTable != row[DumpTableKey] || fk.ReferencingCol != col {
+			continue
+		}
+		if _, ok := db.pkGroups[fk.BaseTable]; !ok {
+			// only tables with a primary key are mapped
+			return fk, v, true, false
+		}
+		if len(db.references) > 0 && !resolved[fk.BaseTable+"\x00"+textValue(v)] {
+			if replaced, ok := db.resolveReference(fk, row, v, unresolved); ok {
+				return fk, replaced, true, false
+			}
+		}
+		return fk, v, true, true
+	}
+	return ForeignKey{}, v, false, false
+}
+
+// resolvedKeys returns the primary keys, by table, of every row that references of `rows` can be mapped onto:
+// rows being inserted, and the referenced rows that earlier inserts mapped.
+func (db pgbatchtx) resolvedKeys(rows []map[string]any) (map[string]bool, error) {
+	resolved := map[string]bool{}
+	if len(db.references) == 0 {
+		return resolved, nil
+	}
+	for _, row := range rows {
+		table := row[DumpTableKey].(string)
+		if pk, ok := db.pkGroups[table]; ok && row[pk.ColumnName] != nil {
+			resolved[table+"\x00"+textValue(row[pk.ColumnName])] = true
+		}
+	}
+	clones, err := db.clonesOf(rows)
+	if err != nil {
+		return nil, err
+	}
+	for key := range clones {
+		resolved[key] = true
+	}
+	return resolved, nil
+}
+
+// checkReferences returns the references of `rows` that can't be resolved and must fail the upload, so that
+// nothing is inserted when any row has one, even when rows are inserted in chunks.
+func (db pgtx) checkReferences(rows []map[string]any, resolved map[string]bool) error {
+	if len(db.references) == 0 {
+		return nil
+	}
+	unresolved := UnresolvedReferencesError{}
+	for _, row := range rows {
+		for _, fk := range db.fks {
+			v := row[fk.ReferencingCol]
+			if fk.ReferencingTable != row[DumpTableKey] || v == nil {
+				continue
+			}
+			if _, ok := db.pkGroups[fk.BaseTable]; ok && !resolved[fk.BaseTable+"\x00"+textValue(v)] {
+				db.resolveReference(fk, row, v, &unresolved)
+			}
+		}
+	}
+	if len(unresolved.References) > 0 {
+		return unresolved
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package datapasta
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Schema describes the tables of a database, so a dump can be checked against the database it's uploaded to.
+type Schema struct {
+	Tables      map[string]SchemaTable `json:"tables"`
+	ForeignKeys []ForeignKey           `json:"foreign_keys"`
+}
+
+// SchemaTable describes the columns and primary key of a table.
+type SchemaTable struct {
+	Columns    map[string]SchemaColumn `json:"columns"`
+	PrimaryKey []string                `json:"primary_key,omitempty"`
+}
+
+// SchemaColumn describes a column.
+type SchemaColumn struct {
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	// HasDefault is set if the column gets a value when none is inserted, from a default, an identity or a generated expression.
+	HasDefault bool `json:"has_default"`
+}
+
+// Fingerprint is a hash of the schema, which is the same for any two equal schemas.
+func (s Schema) Fingerprint() string {
+	fks := append([]ForeignKey{}, s.ForeignKeys...)
+	sortForeignKeys(fks)
+	s.ForeignKeys = fks
+	// maps are written with sorted keys, so the json is canonical
+	out, _ := json.Marshal(s)
+	sum := sha256.Sum256(out)
+	return hex.EncodeToString(sum[:])
+}
+
+func sortForeignKeys(fks []ForeignKey) {
+	sort.Slice(fks, func(i, j int) bool {
+		a, b := fks[i], fks[j]
+		if a.ReferencingTable != b.ReferencingTable {
+			return a.ReferencingTable < b.ReferencingTable
+		}
+		if a.ReferencingCol != b.ReferencingCol {
+			return a.ReferencingCol < b.ReferencingCol
+		}
+		if a.BaseTable != b.BaseTable {
+			return a.BaseTable < b.BaseTable
+		}
+		return a.BaseCol < b.BaseCol
+	})
+}
+
+// SchemaDifference is a difference between the schema a dump was exported from and the one it's uploaded to,
+// which would make the upload fail.
+type SchemaDifference struct {
+	Table, Column string
+	Problem       string
+}
+
+func (d SchemaDifference) String() string {
+	if d.Column == "" {
+		return d.Table + ": " + d.Problem
+	}
+	return d.Table + "." + d.Column + ": " + d.Problem
+}
+
+// SchemaMismatchError is returned by CheckSchema, listing every difference found.
+type SchemaMismatchError struct {
+	Differences []SchemaDifference
+}
+
+func (e SchemaMismatchError) Error() string {
+	diffs := make([]string, 0, len(e.Differences))
+	for _, d := range e.Differences {
+		diffs = append(diffs, d.String())
+	}
+	return fmt.Sprintf("%d schema differences: %s", len(diffs), strings.Join(diffs, ", "))
+}
+
+// CheckSchema checks that the tables of `dump`, exported from `source`, can be uploaded to a database with schema `dest`.
+// It returns a SchemaMismatchError listing missing tables and columns (suggesting a rename where a new column has
+// the same type), changed column types and primary keys, and NOT NULL columns without a default that rows have no value for.
+func CheckSchema(dump DatabaseDump, source, dest Schema) error {
+	if source.Fingerprint() == dest.Fingerprint() {
+		return nil
+	}
+
+	// how many rows each table has, which columns they have values for, and how many have no value for each column
+	rowCount := map[string]int{}
+	present := map[string]map[string]SchemaColumn{}
+	nulls := map[string]map[string]int{}
+	for _, row := range dump {
+		table := row[DumpTableKey].(string)
+		if rowCount[table] == 0 {
+			present[table] = map[string]SchemaColumn{}
+			nulls[table] = map[string]int{}
+		}
+		rowCount[table]++
+		for col, v := range row {
+			if v != nil && col != DumpTableKey {
+				present[table][col] = SchemaColumn{}
+			}
+		}
+		for col := range dest.Tables[table].Columns {
+			if row[col] == nil {
+				nulls[table][col]++
+			}
+		}
+	}
+
+	mismatch := SchemaMismatchError{}
+	add := func(table, col, problem string, args ...any) {
+		mismatch.Differences = append(mismatch.Differences, SchemaDifference{Table: table, Column: col, Problem: fmt.Sprintf(problem, args...)})
+	}
+	for _, table := range sortedKeys(rowCount) {
+		from, to := source.Tables[table], dest.Tables[table]
+		if to.Columns == nil {
+			add(table, "", "table is missing")
+			continue
+		}
+		if from.Columns == nil {
+			// without a recorded schema, only the columns with values in the dump can be checked
+			from.Columns = present[table]
+		} else if strings.Join(from.PrimaryKey, ",") != strings.Join(to.PrimaryKey, ",") {
+			add(table, "", "primary key changed from (%s) to (%s)", strings.Join(from.PrimaryKey, ", "), strings.Join(to.PrimaryKey, ", "))
+		}
+
+		for _, col := range sortedKeys(from.Columns) {
+			was := from.Columns[col]
+			now, ok := to.Columns[col]
+			if !ok {
+				// a rename is suggested if exactly one new column has the same type
+				renamed := []string{}
+				for _, a := range sortedKeys(to.Columns) {
+					if _, existed := from.Columns[a]; !existed && was.Type != "" && to.Columns[a].Type == was.Type {
+						renamed = append(renamed, a)
+					}
+				}
+				if len(renamed) == 1 {
+					add(table, col, "column is missing, it may have been renamed to %s", renamed[0])
+				} else {
+					add(table, col, "column is missing")
+				}
+				continue
+			}
+			if was.Type != "" && was.Type != now.Type {
+				add(table, col, "type changed from %s to %s", was.Type, now.Type)
+			}
+		}
+
+		for _, col := range sortedKeys(to.Columns) {
+			now := to.Columns[col]
+			if now.Nullable || now.HasDefault || nulls[table][col] == 0 {
+				continue
+			}
+			if _, existed := from.Columns[col]; existed {
+				add(table, col, "NOT NULL column without a default, which %d of %d rows have no value for", nulls[table][col], rowCount[table])
+			} else {
+				add(table, col, "new NOT NULL column without a default, which %d of %d rows have no value for", nulls[table][col], rowCount[table])
+			}
+		}
+	}
+
+	if len(mismatch.Differences) > 0 {
+		return mismatch
+	}
+	return nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,108 @@
+package datapasta
+
+import "fmt"
+
+// SchemaMapping describes how to move a dump into a schema that diverged from the one it was exported from,
+// such as a newer version of the same database or another service's copy of it.
+// It can be loaded from JSON, and is applied with Apply before Upload.
+type SchemaMapping struct {
+	// Tables renames tables, from the old name to the new one.
+	Tables map[string]string `json:"tables,omitempty"`
+	// Columns renames columns, by their old table name, from the old column name to the new one.
+	Columns map[string]map[string]string `json:"columns,omitempty"`
+	// Drop removes columns, by their old table name.
+	Drop map[string][]string `json:"drop,omitempty"`
+	// Defaults are the values given to columns that rows have no value for, by the new table and column names,
+	// such as for new NOT NULL columns.
+	Defaults map[string]map[string]any `json:"defaults,omitempty"`
+}
+
+func (m SchemaMapping) table(table string) string {
+	if renamed, ok := m.Tables[table]; ok {
+		return renamed
+	}
+	return table
+}
+
+func (m SchemaMapping) column(table, col string) string {
+	if renamed, ok := m.Columns[table][col]; ok {
+		return renamed
+	}
+	return col
+}
+
+func (m SchemaMapping) dropped(table, col string) bool {
+	for _, d := range m.Drop[table] {
+		if d == col {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns a copy of the dump with the mapping applied, leaving `dump` as it is.
+func (m SchemaMapping) Apply(dump DatabaseDump) (DatabaseDump, error) {
+	out := make(DatabaseDump, 0, len(dump))
+	for i, row := range dump {
+		table := row[DumpTableKey].(string)
+		newTable := m.table(table)
+		mapped := make(map[string]any, len(row))
+		for col, v := range row {
+			if col == DumpTableKey || m.dropped(table, col) {
+				continue
+			}
+			newCol := m.column(table, col)
+			if _, ok := row[newCol]; ok && newCol != col && m.column(table, newCol) == newCol && !m.dropped(table, newCol) {
+				return nil, fmt.Errorf("row %d: %s.%s is renamed to %s, which the row already has", i, table, col, newCol)
+			}
+			mapped[newCol] = v
+		}
+		for col, v := range m.Defaults[newTable] {
+			if mapped[col] == nil {
+				mapped[col] = v
+			}
+		}
+		mapped[DumpTableKey] = newTable
+		out = append(out, mapped)
+	}
+	return out, nil
+}
+
+// ApplySchema returns the schema a dump was exported from as it is after Apply,
+// with its tables, columns, primary keys and foreign keys renamed, and dropped columns left out.
+// Columns with a default in the mapping are marked as having a default.
+func (m SchemaMapping) ApplySchema(schema Schema) Schema {
+	out := Schema{Tables: make(map[string]SchemaTable, len(schema.Tables)), ForeignKeys: make([]ForeignKey, 0, len(schema.ForeignKeys))}
+	for table, t := range schema.Tables {
+		newTable := m.table(table)
+		mapped := SchemaTable{Columns: make(map[string]SchemaColumn, len(t.Columns))}
+		for col, c := range t.Columns {
+			if !m.dropped(table, col) {
+				mapped.Columns[m.column(table, col)] = c
+			}
+		}
+		for col := range m.Defaults[newTable] {
+			if c, ok := mapped.Columns[col]; ok {
+				c.HasDefault = true
+				mapped.Columns[col] = c
+			}
+		}
+		for _, col := range t.PrimaryKey {
+			mapped.PrimaryKey = append(mapped.PrimaryKey, m.column(table, col))
+		}
+		out.Tables[newTable] = mapped
+	}
+	for _, fk := range schema.ForeignKeys {
+		if m.dropped(fk.ReferencingTable, fk.ReferencingCol) || m.dropped(fk.BaseTable, fk.BaseCol) {
+			continue
+		}
+		out.ForeignKeys = append(out.ForeignKeys, ForeignKey{
+			BaseTable:        m.table(fk.BaseTable),
+			BaseCol:          m.column(fk.BaseTable, fk.BaseCol),
+			ReferencingTable: m.table(fk.ReferencingTable),
+			ReferencingCol:   m.column(fk.ReferencingTable, fk.ReferencingCol),
+		})
+	}
+	sortForeignKeys(out.ForeignKeys)
+	return out
+}
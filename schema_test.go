@@ -0,0 +1,113 @@
+package datapasta
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSchema(t *testing.T) {
+	ok := assert.New(t)
+	source := Schema{
+		Tables: map[string]SchemaTable{
+			"user": {
+				Columns: map[string]SchemaColumn{
+					"id":         {Type: "integer", HasDefault: true},
+					"email":      {Type: "text"},
+					"first_name": {Type: "character varying(50)", Nullable: true},
+					"age":        {Type: "integer", Nullable: true},
+				},
+				PrimaryKey: []string{"id"},
+			},
+			"audit": {Columns: map[string]SchemaColumn{"id": {Type: "bigint"}}, PrimaryKey: []string{"id"}},
+		},
+		ForeignKeys: []ForeignKey{{BaseTable: "user", BaseCol: "id", ReferencingTable: "audit", ReferencingCol: "user_id"}},
+	}
+	dump := DatabaseDump{
+		{DumpTableKey: "user", "id": 1, "email": "a@example.com", "first_name": "Al", "age": 30},
+		{DumpTableKey: "user", "id": 2, "email": "b@example.com", "first_name": nil, "age": nil},
+		{DumpTableKey: "audit", "id": 1},
+	}
+
+	// the same schema, even with foreign keys in another order, is always compatible
+	ok.Equal(source.Fingerprint(), Schema{Tables: source.Tables, ForeignKeys: append([]ForeignKey{}, source.ForeignKeys...)}.Fingerprint())
+	ok.NoError(CheckSchema(dump, source, source))
+
+	dest := Schema{Tables: map[string]SchemaTable{
+		"user": {
+			Columns: map[string]SchemaColumn{
+				"id":         {Type: "integer", HasDefault: true},
+				"email":      {Type: "text"},
+				"given_name": {Type: "character varying(50)", Nullable: true},
+				"age":        {Type: "bigint"},
+				"tenant_id":  {Type: "integer"},
+				"created_at": {Type: "timestamp with time zone", HasDefault: true},
+			},
+			PrimaryKey: []string{"id"},
+		},
+	}}
+	err := CheckSchema(dump, source, dest)
+	ok.Equal(SchemaMismatchError{Differences: []SchemaDifference{
+		{Table: "audit", Problem: "table is missing"},
+		{Table: "user", Column: "age", Problem: "type changed from integer to bigint"},
+		{Table: "user", Column: "first_name", Problem: "column is missing, it may have been renamed to given_name"},
+		{Table: "user", Column: "age", Problem: "NOT NULL column without a default, which 1 of 2 rows have no value for"},
+		{Table: "user", Column: "tenant_id", Problem: "new NOT NULL column without a default, which 2 of 2 rows have no value for"},
+	}}, err)
+	ok.EqualError(err, "5 schema differences: audit: table is missing, user.age: type changed from integer to bigint, "+
+		"user.first_name: column is missing, it may have been renamed to given_name, "+
+		"user.age: NOT NULL column without a default, which 1 of 2 rows have no value for, "+
+		"user.tenant_id: new NOT NULL column without a default, which 2 of 2 rows have no value for")
+
+	// without a recorded schema, the columns of the dump are checked
+	err = CheckSchema(dump[:2], Schema{}, dest)
+	ok.EqualError(err, "3 schema differences: user.first_name: column is missing, "+
+		"user.age: NOT NULL column without a default, which 1 of 2 rows have no value for, "+
+		"user.tenant_id: new NOT NULL column without a default, which 2 of 2 rows have no value for")
+}
+
+func TestSchemaMapping(t *testing.T) {
+	ok := assert.New(t)
+	m := SchemaMapping{
+		Tables:   map[string]string{"user": "account"},
+		Columns:  map[string]map[string]string{"user": {"first_name": "given_name"}, "post": {"user_id": "account_id"}},
+		Drop:     map[string][]string{"user": {"legacy_flags"}},
+		Defaults: map[string]map[string]any{"account": {"tenant_id": 1, "given_name": "unknown"}},
+	}
+	dump := DatabaseDump{
+		{DumpTableKey: "user", "id": 1, "first_name": "Al", "legacy_flags": 3},
+		{DumpTableKey: "user", "id": 2, "first_name": nil, "tenant_id": 4},
+		{DumpTableKey: "post", "id": 9, "user_id": 1},
+	}
+
+	mapped, err := m.Apply(dump)
+	ok.NoError(err)
+	ok.Equal(DatabaseDump{
+		{DumpTableKey: "account", "id": 1, "given_name": "Al", "tenant_id": 1},
+		{DumpTableKey: "account", "id": 2, "given_name": "unknown", "tenant_id": 4},
+		{DumpTableKey: "post", "id": 9, "account_id": 1},
+	}, mapped)
+	ok.Equal("user", dump[0][DumpTableKey])
+
+	schema := m.ApplySchema(Schema{
+		Tables: map[string]SchemaTable{
+			"user": {Columns: map[string]SchemaColumn{
+				"id":           {Type: "integer"},
+				"first_name":   {Type: "text"},
+				"legacy_flags": {Type: "integer"},
+			}, PrimaryKey: []string{"id"}},
+			"post": {Columns: map[string]SchemaColumn{"id": {Type: "integer"}, "user_id": {Type: "integer"}}, PrimaryKey: []string{"id"}},
+		},
+		ForeignKeys: []ForeignKey{{BaseTable: "user", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "user_id"}},
+	})
+	ok.Equal(Schema{
+		Tables: map[string]SchemaTable{
+			"account": {Columns: map[string]SchemaColumn{"id": {Type: "integer"}, "given_name": {Type: "text", HasDefault: true}}, PrimaryKey: []string{"id"}},
+			"post":    {Columns: map[string]SchemaColumn{"id": {Type: "integer"}, "account_id": {Type: "integer"}}, PrimaryKey: []string{"id"}},
+		},
+		ForeignKeys: []ForeignKey{{BaseTable: "account", BaseCol: "id", ReferencingTable: "post", ReferencingCol: "account_id"}},
+	}, schema)
+
+	_, err = SchemaMapping{Columns: map[string]map[string]string{"user": {"first_name": "id"}}}.Apply(dump[:1])
+	ok.EqualError(err, "row 0: user.first_name is renamed to id, which the row already has")
+}
@@ -0,0 +1,188 @@
+package datapasta
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// UniqueRewrite returns the value to insert instead of `value` in a unique column, so that a clone doesn't
+// conflict with the row it was cloned from.
+type UniqueRewrite func(table, column string, value any) (any, error)
+
+// RewriteUniques makes Insert rewrite the value of every unique column found by UniqueColumns with `rewrite`.
+// Rewritten values are written back to the uploaded rows.
+func RewriteUniques(rewrite UniqueRewrite) ClientOpt {
+	return func(db *pgtx) {
+		if db.rewrites == nil {
+			db.rewrites = map[string]UniqueRewrite{}
+		}
+		db.rewrites[""] = rewrite
+	}
+}
+
+// RewriteUnique makes Insert rewrite the value of `table`.`column` with `rewrite`, overriding RewriteUniques.
+// The column doesn't need to be found by UniqueColumns, and a nil rewrite leaves it as it is.
+func RewriteUnique(table, column string, rewrite UniqueRewrite) ClientOpt {
+	return func(db *pgtx) {
+		if db.rewrites == nil {
+			db.rewrites = map[string]UniqueRewrite{}
+		}
+		db.rewrites[table+"."+column] = rewrite
+	}
+}
+
+// NullUnique sets unique columns to NULL. The batch client leaves NULL values to the column's default.
+func NullUnique(table, column string, value any) (any, error) {
+	return nil, nil
+}
+
+// SuffixUnique appends `suffix` to unique text columns.
+func SuffixUnique(suffix string) UniqueRewrite {
+	return func(table, column string, value any) (any, error) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("can't add a suffix to %s.%s, which is a %T", table, column, value)
+		}
+		return s + suffix, nil
+	}
+}
+
+// RandomUnique replaces unique columns with a random value of the same kind:
+// a new UUID for UUIDs, random hex of the same length (and at least 16 characters) for other text, and a random positive integer for numbers.
+func RandomUnique(table, column string, value any) (any, error) {
+	switch v := value.(type) {
+	case string:
+		n := len(v)
+		if n < 16 {
+			n = 16
+		}
+		b := make([]byte, (n+1)/2)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		if isUUID(v) {
+			b[6] = b[6]&0x0f | 0x40
+			b[8] = b[8]&0x3f | 0x80
+			h := hex.EncodeToString(b[:16])
+			return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+		}
+		return hex.EncodeToString(b)[:n], nil
+	case int16:
+		n, err := randomInt(1<<15 - 1)
+		return int16(n), err
+	case int32:
+		n, err := randomInt(1<<31 - 1)
+		return int32(n), err
+	case int64:
+		return randomInt(1<<31 - 1)
+	case int:
+		n, err := randomInt(1<<31 - 1)
+		return int(n), err
+	case float64:
+		// numbers that went through json
+		n, err := randomInt(1<<31 - 1)
+		return float64(n), err
+	}
+	return nil, fmt.Errorf("can't randomize %s.%s, which is a %T", table, column, value)
+}
+
+// randomInt returns a random integer between 1 and max.
+func randomInt(max int64) (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		return 0, err
+	}
+	return n.Int64() + 1, nil
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return false
+	}
+	_, err := hex.DecodeString(s[:8] + s[9:13] + s[14:18] + s[19:23] + s[24:])
+	return err == nil
+}
+
+// UniqueColumns returns, by table, the columns of every unique constraint or index other than the primary key.
+// Indexes that include the primary key or a foreign key are left out, as cloned rows get new values for those.
+func (db pgdb) UniqueColumns() map[string][]string {
+	return db.uniques
+}
+
+func uniqueColumns(pks map[string]getPrimaryKeysRow, fks []ForeignKey, indexes []getUniqueIndexesRow) map[string][]string {
+	remapped := map[string]bool{}
+	for _, pk := range pks {
+		remapped[pk.TableName+"."+pk.ColumnName] = true
+	}
+	for _, fk := range fks {
+		remapped[fk.ReferencingTable+"."+fk.ReferencingCol] = true
+	}
+
+	cols := map[string]map[string]bool{}
+	for _, idx := range indexes {
+		skip := false
+		for _, col := range idx.ColumnNames {
+			skip = skip || remapped[idx.TableName+"."+col]
+		}
+		if skip {
+			continue
+		}
+		if cols[idx.TableName] == nil {
+			cols[idx.TableName] = map[string]bool{}
+		}
+		for _, col := range idx.ColumnNames {
+			cols[idx.TableName][col] = true
+		}
+	}
+
+	out := make(map[string][]string, len(cols))
+	for table, set := range cols {
+		for col := range set {
+			out[table] = append(out[table], col)
+		}
+		sort.Strings(out[table])
+	}
+	return out
+}
+
+// rewriteUniques applies the configured rewrites to the non-NULL unique columns of a row being inserted.
+// Columns used by MatchExisting are left alone, so they can still match.
+func (db pgtx) rewriteUniques(row map[string]any) error {
+	if len(db.rewrites) == 0 {
+		return nil
+	}
+	table := row[DumpTableKey].(string)
+	match, matching := db.matches[table]
+
+	cols := append([]string{}, db.uniques[table]...)
+	for key := range db.rewrites {
+		if strings.HasPrefix(key, table+".") {
+			cols = append(cols, strings.TrimPrefix(key, table+"."))
+		}
+	}
+
+	done := map[string]bool{}
+	for _, col := range cols {
+		if done[col] || row[col] == nil || (matching && match.includes(col)) {
+			continue
+		}
+		done[col] = true
+		rewrite, ok := db.rewrites[table+"."+col]
+		if !ok {
+			rewrite = db.rewrites[""]
+		}
+		if rewrite == nil {
+			continue
+		}
+		v, err := rewrite(table, col, row[col])
+		if err != nil {
+			return err
+		}
+		row[col] = v
+	}
+	return nil
+}